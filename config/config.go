@@ -4,6 +4,7 @@ Package config provides a way to find and load SOPS configuration files
 package config //import "go.mozilla.org/sops/v3/config"
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -64,6 +65,9 @@ func FindConfigFile(start string) (string, error) {
 	return "", fmt.Errorf("Config file not found")
 }
 
+// ErrNoMatchingCreationRule is returned when no creation rule matches the file path
+var ErrNoMatchingCreationRule = errors.New("error loading config: no matching creation rules found")
+
 type configFile struct {
 	CreationRules    []creationRule    `yaml:"creation_rules"`
 	DestinationRules []destinationRule `yaml:"destination_rules"`
@@ -347,7 +351,7 @@ func parseCreationRuleForFile(conf *configFile, confPath, filePath string, kmsEn
 	}
 
 	if rule == nil {
-		return nil, fmt.Errorf("error loading config: no matching creation rules found")
+		return nil, ErrNoMatchingCreationRule
 	}
 
 	config, err := configFromRule(rule, kmsEncryptionContext)
@@ -370,6 +374,27 @@ func LoadCreationRuleForFile(confPath string, filePath string, kmsEncryptionCont
 	return parseCreationRuleForFile(conf, confPath, filePath, kmsEncryptionContext)
 }
 
+// CreationRules holds the creation rules of a parsed config file
+type CreationRules struct {
+	conf *configFile
+	path string
+}
+
+// LoadCreationRules parses the config file at confPath once, so that rules
+// for many files can be looked up without reading the file again.
+func LoadCreationRules(confPath string) (*CreationRules, error) {
+	conf, err := loadConfigFile(confPath)
+	if err != nil {
+		return nil, err
+	}
+	return &CreationRules{conf: conf, path: confPath}, nil
+}
+
+// ForFile works the same as LoadCreationRuleForFile on the parsed config file.
+func (r *CreationRules) ForFile(filePath string, kmsEncryptionContext map[string]*string) (*Config, error) {
+	return parseCreationRuleForFile(r.conf, r.path, filePath, kmsEncryptionContext)
+}
+
 // LoadDestinationRuleForFile works the same as LoadCreationRuleForFile, but gets the "creation_rule" from the matching destination_rule's
 // "recreation_rule".
 func LoadDestinationRuleForFile(confPath string, filePath string, kmsEncryptionContext map[string]*string) (*Config, error) {
@@ -30,6 +30,10 @@ type action struct {
 	w *git.Worktree       // worktree
 	s *filesystem.Storage // storer
 	d string              // repo dir
+
+	dataKeys   dataKeyCache // decrypted data keys
+	filterOpts *options     // options shared by filters
+	locked     lockedFiles  // files left encrypted in no-key mode
 }
 
 // newAction creates "action" wrapper for cli and repository
@@ -76,7 +80,10 @@ func (a *action) testMangle(path string, mangle bool) error {
 	if err != nil {
 		return err
 	}
-	opts := baseOpts.forPath(path)
+	opts, err := baseOpts.forPath(path)
+	if err != nil {
+		return err
+	}
 	in, err := getInput(path, false)
 	if err != nil {
 		return err
@@ -0,0 +1,214 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.mozilla.org/sops/v3/keyservice"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/pkg/errors"
+)
+
+const defaultAgentTTL = 30 * time.Minute
+
+var errNoAgent = errors.New("agent is not running")
+
+// agentServer is a key service which keeps decrypted data keys
+// in memory for a while. Entries are keyed by master key and the
+// encrypted data key, which is unique for every file data key.
+type agentServer struct {
+	keyservice.Server
+	ttl   time.Duration
+	mu    sync.Mutex
+	cache map[string]agentEntry
+}
+
+type agentEntry struct {
+	plaintext []byte
+	expires   time.Time
+}
+
+func agentCacheKey(req *keyservice.DecryptRequest) string {
+	return req.Key.String() + "\x00" + string(req.Ciphertext)
+}
+
+// Decrypt returns cached data key or asks the master key
+func (s *agentServer) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	id := agentCacheKey(req)
+	s.mu.Lock()
+	entry, ok := s.cache[id]
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		log.Debugf("agent: cache hit for %s", req.Key)
+		return &keyservice.DecryptResponse{Plaintext: entry.plaintext}, nil
+	}
+	rsp, err := s.Server.Decrypt(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.cache[id] = agentEntry{plaintext: rsp.Plaintext, expires: time.Now().Add(s.ttl)}
+	s.mu.Unlock()
+	log.Debugf("agent: cached data key for %s", req.Key)
+	return rsp, nil
+}
+
+// expire wipes stale entries, or all entries if forced
+func (s *agentServer) expire(all bool) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, entry := range s.cache {
+		if all || now.After(entry.expires) {
+			for i := range entry.plaintext {
+				entry.plaintext[i] = 0
+			}
+			delete(s.cache, id)
+		}
+	}
+}
+
+// agentSocket returns socket path given by user or the default one
+func (a *action) agentSocket(socket string) (string, error) {
+	if socket == "" {
+		socket = a.dotGit("sops", "agent.sock")
+	}
+	return filepath.Abs(socket)
+}
+
+// runAgent serves cached key service on the unix socket until killed.
+// The process id is kept next to the socket, SIGHUP wipes the cache.
+func (a *action) runAgent(socket string, ttl time.Duration) error {
+	socket, err := a.agentSocket(socket)
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = defaultAgentTTL
+	}
+	if _, err := agentProcess(socket); err == nil {
+		return fmt.Errorf("agent is already running on %s", socket)
+	}
+	if err := os.MkdirAll(filepath.Dir(socket), permSecretDir); err != nil {
+		return errors.Wrap(err, "create socket directory")
+	}
+	_ = os.Remove(socket) // stale socket of killed agent
+	lis, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = lis.Close()
+		_ = os.Remove(socket + ".pid")
+	}()
+	if err := os.Chmod(socket, permSecret); err != nil {
+		return err
+	}
+	pid := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	if err := ioutil.WriteFile(socket+".pid", pid, permSecret); err != nil {
+		return err
+	}
+
+	srv := &agentServer{ttl: ttl, cache: map[string]agentEntry{}}
+	grpcServer := grpc.NewServer()
+	keyservice.RegisterKeyServiceServer(grpcServer, srv)
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				srv.expire(false)
+			case sig := <-sigc:
+				if sig == syscall.SIGHUP {
+					srv.expire(true)
+					log.Info("agent: cache wiped")
+					continue
+				}
+				log.Infof("agent: caught signal %s, shutting down", sig)
+				srv.expire(true)
+				grpcServer.Stop()
+				return
+			}
+		}
+	}()
+
+	log.Infof("agent: caching data keys for %v", ttl)
+	fmt.Printf("git config sops.keyservice unix://%s\n", socket)
+	return grpcServer.Serve(lis)
+}
+
+// lockAgent makes running agent forget all data keys
+func (a *action) lockAgent(socket string) error {
+	socket, err := a.agentSocket(socket)
+	if err != nil {
+		return err
+	}
+	proc, err := agentProcess(socket)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		return errors.Wrap(err, "signal agent")
+	}
+	fmt.Println("agent locked")
+	return nil
+}
+
+// agentProcess finds live agent by its pid file
+func agentProcess(socket string) (*os.Process, error) {
+	data, err := ioutil.ReadFile(socket + ".pid")
+	if err != nil {
+		return nil, errNoAgent
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errNoAgent
+	}
+	proc, err := os.FindProcess(pid)
+	if err == nil {
+		err = proc.Signal(syscall.Signal(0))
+	}
+	if err != nil {
+		return nil, errNoAgent
+	}
+	return proc, nil
+}
+
+// dialKeyService connects to key service given by URI,
+// e.g. unix:///path/to/socket or tcp://host:port
+func dialKeyService(uri string) (keyservice.KeyServiceClient, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Scheme == "unix" {
+		addr = u.Path
+	}
+	conn, err := grpc.Dial(addr,
+		grpc.WithInsecure(),
+		grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+			return net.DialTimeout(u.Scheme, addr, timeout)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return keyservice.NewKeyServiceClient(conn), nil
+}
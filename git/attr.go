@@ -0,0 +1,171 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const gitAttrFileName = ".gitattributes"
+
+// attrRule is a gitattributes pattern which sets or resets a filter driver
+type attrRule struct {
+	pattern attrPattern
+	ours    bool // filter=<driver>, otherwise unset or other driver
+}
+
+// attrPattern is a gitattributes path pattern relative to the directory
+// of its .gitattributes file, matched like git does it with wildmatch
+type attrPattern struct {
+	domain   []string
+	glob     string
+	basename bool // pattern without slash matches file name at any depth
+}
+
+// readAttrRules parses all .gitattributes files found among the files at given
+// location. Rules are returned in order of increasing priority: the root file
+// goes first, deeper files follow their parent directories.
+func (a *action) readAttrRules(allFiles []string, loc, driver string) ([]attrRule, error) {
+	attrFiles := filterAttrFiles(allFiles)
+	if len(attrFiles) == 0 {
+		log.Debugf("gitattributes not found in %s", shortLoc(loc))
+		return nil, nil
+	}
+	sort.SliceStable(attrFiles, func(i, j int) bool {
+		return strings.Count(attrFiles[i], "/") < strings.Count(attrFiles[j], "/")
+	})
+
+	var rules []attrRule
+	for _, attrPath := range attrFiles {
+		data, err := a.readGitFile(attrPath, loc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s from %s", attrPath, shortLoc(loc))
+		}
+		splitPath := strings.Split(attrPath, "/")
+		domain := splitPath[:len(splitPath)-1]
+		rules = append(rules, parseAttrRules(data, domain, driver)...)
+	}
+	return rules, nil
+}
+
+// filterAttrFiles picks .gitattributes files from the list
+func filterAttrFiles(allFiles []string) []string {
+	var attrFiles []string
+	for _, path := range allFiles {
+		if isAttrFile(path) {
+			attrFiles = append(attrFiles, path)
+		}
+	}
+	return attrFiles
+}
+
+func isAttrFile(path string) bool {
+	return path == gitAttrFileName || strings.HasSuffix(path, "/"+gitAttrFileName)
+}
+
+// parseAttrRules picks lines mentioning filter attribute from gitattributes
+func parseAttrRules(data []byte, domain []string, driver string) (rules []attrRule) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		glob, attrs := parseAttrLine(scanner.Text())
+		if glob == "" {
+			continue
+		}
+		// negative patterns are forbidden, macros are irrelevant,
+		// directory patterns never match files
+		if glob[0] == '!' || strings.HasPrefix(glob, "[attr]") || strings.HasSuffix(glob, "/") {
+			continue
+		}
+		mentioned, ours := false, false
+		for _, attr := range attrs {
+			name, value := attr, ""
+			if eq := strings.Index(attr, "="); eq != -1 {
+				name, value = attr[:eq], attr[eq+1:]
+			}
+			switch strings.TrimLeft(name, "-!") {
+			case "filter":
+				mentioned = true
+				ours = name == "filter" && value == driver
+			}
+		}
+		if mentioned {
+			rules = append(rules, attrRule{
+				pattern: newAttrPattern(glob, domain),
+				ours:    ours,
+			})
+		}
+	}
+	return
+}
+
+// parseAttrLine splits gitattributes line into pattern and attributes,
+// pattern can be C-style quoted
+func parseAttrLine(line string) (glob string, attrs []string) {
+	line = strings.TrimLeft(line, " \t\r")
+	if line == "" || line[0] == '#' {
+		return "", nil
+	}
+	rest := ""
+	if line[0] == '"' {
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return "", nil // unterminated quote
+		}
+		quoted := line[:end+1]
+		if unquoted, err := strconv.Unquote(quoted); err == nil {
+			glob = unquoted
+		} else {
+			glob = quoted[1:end]
+		}
+		rest = line[end+1:]
+	} else {
+		fields := strings.Fields(line)
+		glob = fields[0]
+		rest = line[len(glob):]
+	}
+	return glob, strings.Fields(rest)
+}
+
+func newAttrPattern(glob string, domain []string) attrPattern {
+	return attrPattern{
+		domain:   domain,
+		glob:     strings.TrimPrefix(glob, "/"),
+		basename: !strings.Contains(glob, "/"),
+	}
+}
+
+func (p attrPattern) match(splitPath []string) bool {
+	if len(splitPath) <= len(p.domain) {
+		return false
+	}
+	for i, dir := range p.domain {
+		if splitPath[i] != dir {
+			return false
+		}
+	}
+	relPath := splitPath[len(p.domain):]
+	if p.basename {
+		return wildmatch(p.glob, relPath[len(relPath)-1], 0)
+	}
+	return wildmatch(p.glob, strings.Join(relPath, "/"), wmPathname)
+}
+
+// matchAttrRules tells whether the last matching rule sets the filter
+func matchAttrRules(rules []attrRule, splitPath []string) bool {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].pattern.match(splitPath) {
+			return rules[i].ours
+		}
+	}
+	return false
+}
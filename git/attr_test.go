@@ -0,0 +1,51 @@
+package git
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAttrRules(t *testing.T) {
+	root := parseAttrRules([]byte(`
+# comment
+*.secret.yaml filter=sops diff=sops
+secret[.-][0-9]*.env filter=sops
+/top/*.json filter=sops
+"quoted name.ini" filter=sops
+*.txt filter=lfs
+[attr]binary -diff -merge -text
+`), nil, gitDriver)
+	sub := parseAttrRules([]byte(`
+plain.secret.yaml -filter
+deep/**/*.yaml filter=sops
+`), []string{"sub"}, gitDriver)
+	rules := append(root, sub...)
+
+	tests := []struct {
+		path  string
+		match bool
+	}{
+		{"a.secret.yaml", true},
+		{"dir/a.secret.yaml", true},
+		{"secret.1.env", true},
+		{"dir/secret-42.env", true},
+		{"secret_1.env", false},
+		{"secret.x.env", false},
+		{"top/a.json", true},
+		{"top/dir/a.json", false},
+		{"dir/top/a.json", false},
+		{"quoted name.ini", true},
+		{"a.txt", false},
+		{"sub/plain.secret.yaml", false},
+		{"sub/other.secret.yaml", true},
+		{"plain.secret.yaml", true},
+		{"sub/deep/a.yaml", true},
+		{"sub/deep/x/y/a.yaml", true},
+		{"deep/a.yaml", false},
+	}
+	for _, tc := range tests {
+		if got := matchAttrRules(rules, strings.Split(tc.path, "/")); got != tc.match {
+			t.Errorf("%s: expected %v, got %v", tc.path, tc.match, got)
+		}
+	}
+}
@@ -19,6 +19,14 @@ func (a *action) markBranch(branchName string, encrypted, pushes bool) (err erro
 			return
 		}
 	}
+	if branchName == "" {
+		// detached HEAD outside of branches
+		policy := detachedDecrypt
+		if encrypted {
+			policy = detachedEncrypt
+		}
+		return a.configSet("", "sops.detached", policy)
+	}
 
 	var branchCfg *config.Branch
 	if branchCfg, err = a.r.Branch(branchName); err != nil {
@@ -2,6 +2,8 @@ package git
 
 import (
 	"fmt"
+	"os"
+	"strings"
 
 	"go.mozilla.org/sops/v3/cmd/sops/codes"
 	"go.mozilla.org/sops/v3/cmd/sops/common"
@@ -17,6 +19,7 @@ var Version = "0.0.0-dev"
 var (
 	errExitNoFile    = common.NewExitError("Error: no file specified", codes.NoFileSpecified)
 	errExitExtraArgs = common.NewExitError("Error: extra arguments", codes.ErrorGeneric)
+	errExitConflict  = common.NewExitError("", codes.ErrorGeneric)
 )
 
 func Commands() []cli.Command {
@@ -37,11 +40,41 @@ func Commands() []cli.Command {
 			Name:  optThreshold,
 			Usage: "The number of master keys required to retrieve the data key with shamir",
 		},
+		cli.StringFlag{
+			Name:   "kms, k",
+			Usage:  "Comma separated list of KMS ARNs, key groups separated by \"|\"",
+			EnvVar: "SOPS_KMS",
+		},
+		cli.StringFlag{
+			Name:   "gcp-kms",
+			Usage:  "Comma separated list of GCP KMS resource IDs, key groups separated by \"|\"",
+			EnvVar: "SOPS_GCP_KMS",
+		},
+		cli.StringFlag{
+			Name:   "azure-kv",
+			Usage:  "Comma separated list of Azure Key Vault URLs, key groups separated by \"|\"",
+			EnvVar: "SOPS_AZURE_KV",
+		},
+		cli.StringFlag{
+			Name:   "pgp, p",
+			Usage:  "Comma separated list of PGP fingerprints, key groups separated by \"|\"",
+			EnvVar: "SOPS_PGP",
+		},
+		cli.StringFlag{
+			Name:   "hc-vault-transit",
+			Usage:  "Comma separated list of Vault key URIs, key groups separated by \"|\"",
+			EnvVar: "SOPS_HC_VAULT_TRANSIT",
+		},
 		cli.StringFlag{
 			Name:   "age, a",
 			Usage:  "Age recipient",
 			EnvVar: "SOPS_AGE",
 		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Path to sops config file with creation rules (by default .sops.yaml is looked up from repository root)",
+			EnvVar: "SOPS_CONFIG",
+		},
 		cli.IntFlag{
 			Name:   "indent",
 			Usage:  "Set default YAML indent",
@@ -77,6 +110,11 @@ func Commands() []cli.Command {
 			Usage:  "Use file modtime as metadata lastmodified",
 			EnvVar: "SOPS_FILE_MODTIME",
 		},
+		cli.BoolFlag{
+			Name:   "no-key",
+			Usage:  "Leave files which cannot be decrypted encrypted in worktree (read-only mode)",
+			EnvVar: "SOPS_NO_KEY",
+		},
 		cli.StringFlag{
 			Name:   "change-dir, C",
 			Usage:  "Run as if started in given path instead of current directory",
@@ -152,6 +190,62 @@ func Commands() []cli.Command {
 				return err
 			},
 		},
+		{
+			Name:  "filter-process",
+			Usage: `serve git long-running filter process protocol on stdin/stdout`,
+			Flags: gitFlags,
+			Action: func(cli *cli.Context) error {
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.filterProcess(os.Stdin, os.Stdout)
+				}
+				return err
+			},
+		},
+		{
+			Name:  "agent",
+			Usage: `run key service caching data keys on unix socket`,
+			Flags: append(
+				gitFlags,
+				cli.StringFlag{
+					Name:   "socket",
+					Usage:  "agent socket path (default: .git/sops/agent.sock)",
+					EnvVar: "SOPS_AGENT_SOCKET",
+				},
+				cli.DurationFlag{
+					Name:   "ttl",
+					Usage:  "how long data keys are cached",
+					Value:  defaultAgentTTL,
+					EnvVar: "SOPS_AGENT_TTL",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.runAgent(cli.String("socket"), cli.Duration("ttl"))
+				}
+				return err
+			},
+		},
+		{
+			Name:  "lock",
+			Usage: `make caching agent forget all data keys`,
+			Flags: append(
+				gitFlags,
+				cli.StringFlag{
+					Name:   "socket",
+					Usage:  "agent socket path (default: .git/sops/agent.sock)",
+					EnvVar: "SOPS_AGENT_SOCKET",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.lockAgent(cli.String("socket"))
+				}
+				return err
+			},
+		},
 		{
 			Name:      "textconv",
 			Usage:     `decrypt data from given file to stdout`,
@@ -185,6 +279,88 @@ func Commands() []cli.Command {
 				return err
 			},
 		},
+		{
+			Name:      "pre-push",
+			Usage:     `pre-push hook refusing to push unencrypted secret files`,
+			ArgsUsage: `[remote [url]]`,
+			Flags:     gitFlags,
+			Action: func(cli *cli.Context) error {
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.prePush(cli.Args().First(), os.Stdin)
+				}
+				return err
+			},
+		},
+		{
+			Name:      "receive-check",
+			Usage:     `pre-receive or update hook rejecting secret files not encrypted for allowed recipients`,
+			ArgsUsage: `[ref old new]`,
+			Flags: append(
+				gitFlags,
+				cli.StringFlag{
+					Name:   "allow",
+					Usage:  "comma separated list of allowed recipients, defaults to sops.allowed-recipients",
+					EnvVar: "SOPS_ALLOWED_RECIPIENTS",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.receiveCheck(cli.Args(), os.Stdin, splitList(cli.String("allow")))
+				}
+				return err
+			},
+		},
+		{
+			Name:      "fsck",
+			Usage:     `verify that secret files in history decrypt and pass MAC check`,
+			ArgsUsage: `[revision...]`,
+			Flags: append(
+				gitFlags,
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print problems as JSON lines",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.fsck(cli.Args(), cli.Bool("json"))
+				}
+				return err
+			},
+		},
+		{
+			Name:      "resolve",
+			Usage:     `resolve merge conflict in secret files taking one side`,
+			ArgsUsage: `--ours|--theirs path...`,
+			Flags: append(
+				gitFlags,
+				cli.BoolFlag{
+					Name:  "ours",
+					Usage: "take version of the current branch",
+				},
+				cli.BoolFlag{
+					Name:  "theirs",
+					Usage: "take version of the merged branch",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				if cli.NArg() == 0 {
+					return errExitNoFile
+				}
+				ours, theirs := cli.Bool("ours"), cli.Bool("theirs")
+				if ours == theirs {
+					return common.NewExitError("Error: use either --ours or --theirs", codes.ErrorGeneric)
+				}
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.resolveConflict(cli.Args(), theirs)
+				}
+				return err
+			},
+		},
 		{
 			Name:      "encrypt",
 			Usage:     `encrypt current branch history`,
@@ -199,6 +375,31 @@ func Commands() []cli.Command {
 					Name:  "progress, P",
 					Usage: "print progress",
 				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue interrupted run from .git/sops/transform",
+				},
+				cli.IntFlag{
+					Name:   "jobs, j",
+					Usage:  "number of files converted in parallel (default: number of CPUs)",
+					EnvVar: "SOPS_JOBS",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "rewrite all local branches and tags",
+				},
+				cli.StringFlag{
+					Name:  "branches",
+					Usage: "comma separated list of other branches to rewrite",
+				},
+				cli.BoolFlag{
+					Name:  "tags",
+					Usage: "rewrite all tags",
+				},
+				cli.BoolFlag{
+					Name:  "full",
+					Usage: "translate all commits ignoring results of previous runs",
+				},
 			),
 			Action: func(cli *cli.Context) error {
 				var branch string
@@ -212,7 +413,7 @@ func Commands() []cli.Command {
 				}
 				a, err := newAction(cli)
 				if err == nil {
-					err = a.transformBranch(branch, true, cli.Bool("force"), cli.Bool("progress"))
+					err = a.transformBranch(branch, true, transformOptions(cli))
 				}
 				return err
 			},
@@ -231,6 +432,31 @@ func Commands() []cli.Command {
 					Name:  "progress, P",
 					Usage: "print progress",
 				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue interrupted run from .git/sops/transform",
+				},
+				cli.IntFlag{
+					Name:   "jobs, j",
+					Usage:  "number of files converted in parallel (default: number of CPUs)",
+					EnvVar: "SOPS_JOBS",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "rewrite all local branches and tags",
+				},
+				cli.StringFlag{
+					Name:  "branches",
+					Usage: "comma separated list of other branches to rewrite",
+				},
+				cli.BoolFlag{
+					Name:  "tags",
+					Usage: "rewrite all tags",
+				},
+				cli.BoolFlag{
+					Name:  "full",
+					Usage: "translate all commits ignoring results of previous runs",
+				},
 			),
 			Action: func(cli *cli.Context) error {
 				var branch string
@@ -244,11 +470,167 @@ func Commands() []cli.Command {
 				}
 				a, err := newAction(cli)
 				if err == nil {
-					err = a.transformBranch(branch, false, cli.Bool("force"), cli.Bool("progress"))
+					err = a.transformBranch(branch, false, transformOptions(cli))
 				}
 				return err
 			},
 		},
+		{
+			Name:      "revoke",
+			Usage:     `re-encrypt history of all branches and tags without a recipient`,
+			ArgsUsage: `recipient`,
+			Flags: append(
+				gitFlags,
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "rewrite dirty repository",
+				},
+				cli.BoolFlag{
+					Name:  "progress, P",
+					Usage: "print progress",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue interrupted run from .git/sops/transform",
+				},
+				cli.IntFlag{
+					Name:   "jobs, j",
+					Usage:  "number of files converted in parallel (default: number of CPUs)",
+					EnvVar: "SOPS_JOBS",
+				},
+				cli.BoolFlag{
+					Name:  "all",
+					Usage: "rewrite all local branches and tags (default without --branches and --tags)",
+				},
+				cli.StringFlag{
+					Name:  "branches",
+					Usage: "comma separated list of other branches to rewrite",
+				},
+				cli.BoolFlag{
+					Name:  "tags",
+					Usage: "rewrite all tags",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				switch cli.NArg() {
+				case 0:
+					return common.NewExitError("Error: no recipient specified", codes.ErrorGeneric)
+				case 1:
+				default:
+					return errExitExtraArgs
+				}
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.revokeRecipient(cli.Args()[0], transformOptions(cli))
+				}
+				return err
+			},
+		},
+		{
+			Name:  "import-ivacrypt",
+			Usage: `re-encrypt history of all branches and tags from legacy cryptor.sh to sops`,
+			Flags: append(
+				gitFlags,
+				cli.IntFlag{
+					Name:  "iter",
+					Usage: "PBKDF2 iterations given to openssl, zero for MD5 key derivation",
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "rewrite dirty repository",
+				},
+				cli.BoolFlag{
+					Name:  "progress, P",
+					Usage: "print progress",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue interrupted run from .git/sops/transform",
+				},
+				cli.IntFlag{
+					Name:   "jobs, j",
+					Usage:  "number of files converted in parallel (default: number of CPUs)",
+					EnvVar: "SOPS_JOBS",
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				if cli.NArg() > 0 {
+					return errExitExtraArgs
+				}
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.importIvacrypt(cli.Int("iter"), transformOptions(cli))
+				}
+				return err
+			},
+		},
+		{
+			Name:  "rotate",
+			Usage: `re-encrypt all secret files with new data keys in a single commit`,
+			Flags: append(
+				gitFlags,
+				cli.BoolFlag{
+					Name:  "if-needed",
+					Usage: "rotate only files with master keys which need rotation",
+				},
+				cli.StringFlag{
+					Name:  "message, m",
+					Usage: "commit message",
+					Value: rotateMessage,
+				},
+			),
+			Action: func(cli *cli.Context) error {
+				if cli.NArg() > 0 {
+					return errExitExtraArgs
+				}
+				a, err := newAction(cli)
+				if err == nil {
+					err = a.rotateKeys(cli.Bool("if-needed"), cli.String("message"))
+				}
+				return err
+			},
+		},
+		{
+			Name:  "recipients",
+			Usage: `change master keys of configuration and all secret files`,
+			Subcommands: []cli.Command{
+				{
+					Name:      "add",
+					Usage:     `add master key to a key group and stage updated files`,
+					ArgsUsage: `key`,
+					Flags: append(
+						gitFlags,
+						cli.IntFlag{
+							Name:  "group",
+							Usage: "number of key group",
+							Value: 1,
+						},
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "only show changes of key groups",
+						},
+					),
+					Action: func(cli *cli.Context) error {
+						return recipientsAction(cli, true)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     `remove master key from all key groups and stage updated files`,
+					ArgsUsage: `key`,
+					Flags: append(
+						gitFlags,
+						cli.BoolFlag{
+							Name:  "dry-run, n",
+							Usage: "only show changes of key groups",
+						},
+					),
+					Action: func(cli *cli.Context) error {
+						return recipientsAction(cli, false)
+					},
+				},
+			},
+		},
 		{
 			Name:      "set-encrypted",
 			Usage:     `mark current branch as encrypted, re-enable push`,
@@ -303,11 +685,16 @@ func Commands() []cli.Command {
 					Usage:  "expected contents of the probed file",
 					EnvVar: "SOPS_PROBE_TEXT",
 				},
+				cli.StringFlag{
+					Name:   "detached",
+					Usage:  `filtering of detached HEAD: "encrypt", "decrypt", "follow-upstream" (default) or "error"`,
+					EnvVar: "SOPS_DETACHED",
+				},
 			),
 			Action: func(cli *cli.Context) error {
 				a, err := newAction(cli)
 				if err == nil {
-					err = a.setupRepo(cli.Bool("force"), cli.String("probe-file"), cli.String("probe-text"))
+					err = a.setupRepo(cli.Bool("force"), cli.String("probe-file"), cli.String("probe-text"), cli.String("detached"))
 				}
 				return err
 			},
@@ -486,3 +873,47 @@ func Commands() []cli.Command {
 
 	return gitCommands
 }
+
+func transformOptions(cli *cli.Context) transformOpts {
+	return transformOpts{
+		force:    cli.Bool("force"),
+		progress: cli.Bool("progress"),
+		resume:   cli.Bool("resume"),
+		jobs:     cli.Int("jobs"),
+		all:      cli.Bool("all"),
+		tags:     cli.Bool("tags"),
+		branches: splitList(cli.String("branches")),
+		full:     cli.Bool("full"),
+	}
+}
+
+// recipientsAction runs recipients add or remove
+func recipientsAction(cli *cli.Context, add bool) error {
+	switch cli.NArg() {
+	case 0:
+		return common.NewExitError("Error: no master key specified", codes.ErrorGeneric)
+	case 1:
+	default:
+		return errExitExtraArgs
+	}
+	group := cli.Int("group")
+	if add && group < 1 {
+		return common.NewExitError("Error: key groups are numbered from 1", codes.ErrorGeneric)
+	}
+	a, err := newAction(cli)
+	if err == nil {
+		err = a.editRecipients(cli.Args()[0], add, group-1, cli.Bool("dry-run"))
+	}
+	return err
+}
+
+// splitList parses comma separated list, empty items are skipped
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,88 @@
+package git
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/cmd/sops/codes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/keyservice"
+
+	"github.com/pkg/errors"
+)
+
+// dataKeyCache keeps data keys decrypted during the process lifetime,
+// so that files sharing a key ask age/KMS only once. It's safe for
+// concurrent use by transformation workers and delayed filters.
+type dataKeyCache struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// dataKeyID identifies data key by all its encrypted copies
+func dataKeyID(meta *sops.Metadata) string {
+	h := sha256.New()
+	for i, group := range meta.KeyGroups {
+		_, _ = fmt.Fprintf(h, "group %d\n", i)
+		for _, key := range group {
+			_, _ = fmt.Fprintf(h, "%T %s %s\n", key, key.ToString(), key.EncryptedDataKey())
+		}
+	}
+	return string(h.Sum(nil))
+}
+
+// getDataKey decrypts data key of the metadata, results are cached
+func (a *action) getDataKey(meta *sops.Metadata, keyServices []keyservice.KeyServiceClient) ([]byte, error) {
+	id := dataKeyID(meta)
+	c := &a.dataKeys
+	c.mu.Lock()
+	dataKey, ok := c.keys[id]
+	c.mu.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+	dataKey, err := meta.GetDataKeyWithKeyServices(keyServices)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.keys == nil {
+		c.keys = map[string][]byte{}
+	}
+	c.keys[id] = dataKey
+	c.mu.Unlock()
+	return dataKey, nil
+}
+
+// dataKeyExitError tells missing master keys from unreachable key
+// services, which the keys may still be available from
+func dataKeyExitError(err error) error {
+	code := codes.CouldNotRetrieveKey
+	if errors.Is(err, sops.ErrKeyServiceUnavailable) {
+		code = codes.ErrorGeneric
+	}
+	return common.NewExitError(err, code)
+}
+
+// decryptTree is a copy of common.DecryptTree using the data key cache
+func (a *action) decryptTree(opts common.DecryptTreeOpts) ([]byte, error) {
+	dataKey, err := a.getDataKey(&opts.Tree.Metadata, opts.KeyServices)
+	if err != nil {
+		return nil, dataKeyExitError(err)
+	}
+	computedMac, err := opts.Tree.Decrypt(dataKey, opts.Cipher)
+	if err != nil {
+		return nil, common.NewExitError(fmt.Sprintf("Error decrypting tree: %s", err), codes.ErrorDecryptingTree)
+	}
+	fileMac, _ := opts.Cipher.Decrypt(opts.Tree.Metadata.MessageAuthenticationCode, dataKey, opts.Tree.Metadata.LastModified.Format(time.RFC3339))
+	if !opts.IgnoreMac && fileMac != computedMac {
+		if fileMac == "" {
+			fileMac = "no MAC"
+		}
+		return nil, common.NewExitError(fmt.Sprintf("MAC mismatch. File has %s, computed %s", fileMac, computedMac), codes.MacMismatch)
+	}
+	return dataKey, nil
+}
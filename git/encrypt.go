@@ -5,30 +5,26 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
-	"strings"
 
 	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/cmd/sops/codes"
 	"go.mozilla.org/sops/v3/cmd/sops/common"
-	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/stores"
 
 	"github.com/pkg/errors"
+	"gopkg.in/urfave/cli.v1"
 )
 
 var errAlreadyEncrypted = errors.New("file already encrypted")
 
-func (t *transformer) encryptFile(path string, input []byte) ([]byte, error) {
-	opts := t.baseOpts.forPath(path)
+func (t *transformer) encryptFile(job *fileJob) ([]byte, error) {
+	path, input, opts := job.path, job.srcData, job.opts
 	dadsHash := shortHash(t.newDadHash)
 
 	// pull metadata from dad file
-	var dadData []byte
 	var dadMeta *sops.Metadata
-	if t.newDadHash != zeroHash {
-		var err error
-		dadData, err = t.a.readGitFile(path, t.newDadHash.String())
-		if err == nil {
-			dadMeta, _ = extractMetadata(path, dadData, opts)
-		}
+	if job.dadData != nil {
+		dadMeta, _ = extractMetadata(job.dadPath, job.dadData, opts)
 	}
 	if dadMeta != nil {
 		log.Debugf("%s:%s dad data key: [%x]", dadsHash, path, dadMeta.DataKey)
@@ -36,31 +32,32 @@ func (t *transformer) encryptFile(path string, input []byte) ([]byte, error) {
 		opts.meta.KeyGroups = dadMeta.KeyGroups
 	}
 
+	// compare with dad, seed cipher stash with dad values
+	if dadMeta != nil {
+		opts.inputData = job.dadData
+		plainDad, err := t.a.sopsDecrypt(opts)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(input, plainDad) {
+			log.Debugf("%s:%s plain file equals plain dad (%s) %s",
+				job.commit, path, dadsHash, traceData(input, job.dadData, nil))
+			return job.dadData, nil
+		}
+	}
+
 	// encrypt file
 	opts.inputData = input
 	output, err := t.a.sopsEncrypt(opts)
 	if err == errAlreadyEncrypted {
 		log.Debugf("%s:%s already encrypted %s",
-			t.shortHash, path, traceData(input, nil, nil))
+			job.commit, path, traceData(input, nil, nil))
 		return input, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	if dadData != nil && dadMeta != nil {
-		// file was plain, dad was encrypted
-		opts.inputData = dadData
-		plainDad, err := t.a.sopsDecrypt(opts)
-		if err != nil {
-			return nil, err
-		}
-		if bytes.Equal(input, plainDad) {
-			log.Debugf("%s:%s plain file equals plain dad (%s) %s",
-				t.shortHash, path, dadsHash, traceData(input, dadData, nil))
-			return dadData, nil
-		}
-	}
-	log.Debugf("%s:%s encrypting %s", t.shortHash, path, traceData(input, output, nil))
+	log.Debugf("%s:%s encrypting %s", job.commit, path, traceData(input, output, nil))
 	return output, nil
 }
 
@@ -131,22 +128,25 @@ func (a *action) sopsEncrypt(opts *options) ([]byte, error) {
 	return output, nil
 }
 
-func (t *transformer) decryptFile(path string, input []byte) ([]byte, error) {
-	opts := t.baseOpts.forPath(path)
+func (t *transformer) decryptFile(job *fileJob) ([]byte, error) {
+	path, input, opts := job.path, job.srcData, job.opts
 	opts.inputData = input
 	output, err := t.a.sopsDecrypt(opts)
-	if isMetaNotFound(err, path) {
-		log.Debugf("%s:%s already decrypted %s", t.shortHash, path, traceData(input, nil, nil))
+	if isMetaNotFound(err) {
+		log.Debugf("%s:%s already decrypted %s", job.commit, path, traceData(input, nil, nil))
 		return input, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("%s:%s decrypting %s", t.shortHash, path, traceData(input, output, nil))
+	log.Debugf("%s:%s decrypting %s", job.commit, path, traceData(input, output, nil))
 	return output, nil
 }
 
 func (a *action) sopsDecrypt(opts *options) ([]byte, error) {
+	if isConflictData(opts.inputData) {
+		return a.decryptConflict(opts)
+	}
 	loadOpts := common.GenericDecryptOpts{
 		Cipher:      opts.cipher,
 		InputStore:  opts.inputStore,
@@ -160,7 +160,7 @@ func (a *action) sopsDecrypt(opts *options) ([]byte, error) {
 		return nil, err
 	}
 
-	dataKey, err := common.DecryptTree(common.DecryptTreeOpts{
+	dataKey, err := a.decryptTree(common.DecryptTreeOpts{
 		Cipher:      opts.cipher,
 		IgnoreMac:   opts.ignoreMac,
 		Tree:        tree,
@@ -182,26 +182,18 @@ func (a *action) sopsDecrypt(opts *options) ([]byte, error) {
 	return output, nil
 }
 
-func isMetaNotFound(err error, path string) bool {
-	const errTextBadJSON = "Error unmarshalling input json"
-	if err == sops.MetadataNotFound {
-		return true
-	}
-	if err != nil {
-		fmt := formats.FormatForPath(path)
-		if fmt == formats.Binary && strings.Contains(err.Error(), errTextBadJSON) {
-			return true
-		}
-	}
-	return false
+// isMetaNotFound tells that the data is not encrypted
+func isMetaNotFound(err error) bool {
+	return errors.Is(err, sops.MetadataNotFound)
 }
 
-func isMergeConflict(err error, input []byte) bool {
-	const errTextBadYAML = "Error unmarshalling input yaml"
-	if err == nil || !strings.Contains(err.Error(), errTextBadYAML) {
-		return false
-	}
-	var currMark = []byte("<<<<<<< CURRENT")
-	var otherMark = []byte(">>>>>>> OTHER")
-	return bytes.Contains(input, currMark) && bytes.Contains(input, otherMark)
+// isKeyMissing tells that no master key could decrypt the data key
+func isKeyMissing(err error) bool {
+	var exit cli.ExitCoder
+	return errors.As(err, &exit) && exit.ExitCode() == codes.CouldNotRetrieveKey
+}
+
+// isMergeConflict tells that the data has merge conflict markers
+func isMergeConflict(err error) bool {
+	return errors.Is(err, stores.ErrConflict)
 }
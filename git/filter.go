@@ -11,36 +11,45 @@ import (
 )
 
 func (a *action) clean(path string, stdin bool, parentLoc, lastModified string) error {
+	input, err := getInput(path, stdin)
+	if err != nil {
+		return err
+	}
+	output, err := a.cleanData(path, input, stdin, parentLoc, lastModified)
+	if err == nil {
+		_, err = os.Stdout.Write(output)
+	}
+	return err
+}
+
+// cleanData encrypts file data for given path
+func (a *action) cleanData(path string, input []byte, stdin bool, parentLoc, lastModified string) ([]byte, error) {
 	rebase := false
 	branch, hash, encrypted, err := a.getState()
 	if err == errRebasing {
 		rebase = true
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 	log.Debugf("sops clean: %q %s '%s' %s",
 		branch, shortHash(hash), filterStatus(encrypted, rebase, stdin), path)
 
-	input, err := getInput(path, stdin)
-	if err != nil {
-		return err
+	if len(input) == 0 || !encrypted {
+		return input, nil // preserve empty input
 	}
-	if len(input) == 0 {
-		return nil // preserve empty input
-	}
-	if !encrypted {
-		_, err = os.Stdout.Write(input)
-		return err
+	if a.isLocked(path, input) {
+		log.Debugf("%s: locked, no key to decrypt it", path)
+		return input, nil
 	}
 
-	baseOpts, err := a.getOptions()
+	baseOpts, err := a.filterOptions(stdin)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if stdin {
-		baseOpts.fileModtime = false
+	opts, err := baseOpts.forPath(path)
+	if err != nil {
+		return nil, err
 	}
-	opts := baseOpts.forPath(path)
 	opts.inputData = input
 
 	var (
@@ -48,14 +57,29 @@ func (a *action) clean(path string, stdin bool, parentLoc, lastModified string)
 		dadMeta *sops.Metadata
 	)
 	if parentLoc != "none" && parentLoc != "" {
-		if dadData, err = a.readGitFile(path, parentLoc); err == nil {
-			dadMeta, err = extractMetadata(path, dadData, opts)
+		dadPath := path
+		dadData, err = a.readGitFile(path, parentLoc)
+		if errors.Cause(err) == errNotFound {
+			// parent may be renamed
+			dadPath, err = a.findRenameSource(path, parentLoc, input, baseOpts)
+			if err == nil && dadPath != "" {
+				log.Debugf("%s: renamed from %s", path, dadPath)
+				dadData, err = a.readGitFile(dadPath, parentLoc)
+			}
+		}
+		if err == nil && dadData != nil {
+			dadMeta, err = extractMetadata(dadPath, dadData, opts)
 		}
-		if errors.Cause(err) == errNotFound || isMetaNotFound(err, path) {
+		if opts.noKey && isKeyMissing(err) {
+			// parent is locked, it can't be compared with
+			log.Debugf("%s: no key to decrypt parent", path)
+			dadMeta, err = nil, nil
+		}
+		if errors.Cause(err) == errNotFound || isMetaNotFound(err) {
 			err = nil
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 	if dadMeta != nil {
@@ -67,96 +91,140 @@ func (a *action) clean(path string, stdin bool, parentLoc, lastModified string)
 		const format = "2006-01-02T15:04:05"
 		lastModifiedTime, err := time.Parse(format, lastModified)
 		if err != nil {
-			return fmt.Errorf("cannot parse time %q using format %q", lastModified, format)
+			return nil, fmt.Errorf("cannot parse time %q using format %q", lastModified, format)
 		}
 		opts.meta.LastModified = lastModifiedTime
 	}
-	output, err := a.sopsEncrypt(opts)
-	if err == errAlreadyEncrypted {
-		log.Debugf("%s: already encrypted", path)
-		output = input
-		err = nil
-	} else if err != nil {
-		return err
-	}
-	// file was not encrypted
 	if dadData != nil && dadMeta != nil {
-		// parent existed and was encrypted
+		// parent existed and was encrypted, decrypting it also seeds
+		// the cipher stash so that unchanged values keep their IVs
 		opts.inputData = dadData
 		plainDad, err := a.sopsDecrypt(opts)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if bytes.Equal(input, plainDad) {
 			log.Debugf("%s: equals decrypted parent", path)
-			output = dadData
-		} else {
-			log.Debugf("%s: encrypting anew", path)
+			return dadData, nil
 		}
+		log.Debugf("%s: encrypting anew, reusing parent ciphertexts", path)
+		opts.inputData = input
 	} else {
 		log.Debugf("%s: encrypting", path)
 	}
+	output, err := a.sopsEncrypt(opts)
+	if err == errAlreadyEncrypted {
+		log.Debugf("%s: already encrypted", path)
+		return input, nil
+	}
+	return output, err
+}
+
+func (a *action) smudge(path string, stdin bool, force bool) error {
+	input, err := getInput(path, stdin)
+	if err != nil {
+		return err
+	}
+	opts, err := a.prepareSmudge(path, input, stdin, force)
+	if err != nil {
+		return err
+	}
+	output := input
+	if opts != nil {
+		output, err = a.smudgeData(opts)
+	}
 	if err == nil {
 		_, err = os.Stdout.Write(output)
 	}
 	return err
 }
 
-func (a *action) smudge(path string, stdin bool, force bool) error {
+// prepareSmudge returns decryption options for file data,
+// or nil options if the data should pass through as is
+func (a *action) prepareSmudge(path string, input []byte, stdin bool, force bool) (*options, error) {
 	rebase := false
 	branch, hash, encrypted, err := a.getState()
 	if err == errRebasing {
 		force = true
 		rebase = true
 	} else if err != nil {
-		return err
+		return nil, err
 	}
 	log.Debugf("sops smudge: %q %s '%s' %s",
 		branch, shortHash(hash), filterStatus(encrypted, rebase, stdin), path)
 
-	input, err := getInput(path, stdin)
-	if err != nil {
-		return err
-	}
 	if len(input) == 0 {
 		log.Debugf("%s: preserve empty input", path)
-		return nil // preserve empty input
+		return nil, nil // preserve empty input
 	}
 
 	if !encrypted && !force {
 		//log.Debugf("%s: branch not encrypted", path)
-		_, err = os.Stdout.Write(input)
-		return err
+		return nil, nil
 	}
 
-	baseOpts, err := a.getOptions()
+	baseOpts, err := a.filterOptions(stdin)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if stdin {
-		baseOpts.fileModtime = false
+	opts, err := baseOpts.forPath(path)
+	if err != nil {
+		return nil, err
 	}
-	opts := baseOpts.forPath(path)
 	opts.inputData = input
+	opts.trackLocked = stdin
+	return opts, nil
+}
 
+// smudgeData decrypts prepared file data, it does not touch git storage
+func (a *action) smudgeData(opts *options) ([]byte, error) {
+	path, input := opts.inputPath, opts.inputData
 	output, err := a.sopsDecrypt(opts)
 	switch {
-	case isMetaNotFound(err, path):
+	case isMetaNotFound(err):
 		log.Debugf("%s: already decrypted", path)
-		output = input
-		_, err = os.Stdout.Write(input)
-	case isMergeConflict(err, input):
+		return input, nil
+	case isMergeConflict(err):
 		log.Warnf("%s: found merge conflict", path)
-		output = input
-		_, err = os.Stdout.Write(input)
+		return input, nil
 	case err == nil:
 		log.Debugf("%s: decrypting", path)
-		_, err = os.Stdout.Write(output)
+		a.trackLocked(opts, false)
+		return output, nil
+	case opts.noKey && isKeyMissing(err):
+		log.Debugf("%s: no key, left encrypted", path)
+		a.trackLocked(opts, true)
+		return input, nil
+	}
+	log.Debugf("file %s error %#v %s", path, err, traceData(input, output, err))
+	return nil, err
+}
+
+// trackLocked updates the list of locked files for smudge filter
+func (a *action) trackLocked(opts *options, locked bool) {
+	if !opts.trackLocked {
+		return
+	}
+	if err := a.setLocked(opts.inputPath, opts.inputData, locked); err != nil {
+		log.Warnf("%s: %v", opts.inputPath, err)
 	}
+}
+
+// filterOptions returns repository options for filters, they are loaded
+// once per process and shared by all files of a filter process
+func (a *action) filterOptions(stdin bool) (*options, error) {
+	if a.filterOpts != nil {
+		return a.filterOpts, nil
+	}
+	baseOpts, err := a.getOptions()
 	if err != nil {
-		log.Debugf("file %s error %#v %s", path, err, traceData(input, output, err))
+		return nil, err
 	}
-	return err
+	if stdin {
+		baseOpts.fileModtime = false
+	}
+	a.filterOpts = baseOpts
+	return baseOpts, nil
 }
 
 func filterStatus(encrypted, rebase, stdin bool) string {
@@ -0,0 +1,117 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"go.mozilla.org/sops/v3/cmd/sops/codes"
+
+	"github.com/pkg/errors"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var errFsck = errors.New("some secret files can't be decrypted")
+
+// kinds of fsck problems
+const (
+	fsckNotEncrypted      = "not-encrypted"
+	fsckUnknownRecipients = "unknown-recipients"
+	fsckNoRecipients      = "no-recipients"
+	fsckMacMismatch       = "mac-mismatch"
+	fsckNoMAC             = "no-mac"
+	fsckDecryptError      = "decrypt-error"
+	fsckParseError        = "parse-error"
+)
+
+// fsckProblem is a line of fsck --json output
+type fsckProblem struct {
+	Blob    string `json:"blob"`
+	Commit  string `json:"commit"`
+	Path    string `json:"path"`
+	Problem string `json:"problem"`
+	Error   string `json:"error"`
+}
+
+// problemKind classifies a failed secret file check
+func problemKind(err error) string {
+	var exit cli.ExitCoder
+	switch {
+	case errors.Is(err, errNotEncrypted):
+		return fsckNotEncrypted
+	case errors.Is(err, errNoRecipients):
+		return fsckNoRecipients
+	case errors.Is(err, errNoMAC):
+		return fsckNoMAC
+	case errors.As(err, &exit):
+		switch exit.ExitCode() {
+		case codes.CouldNotRetrieveKey:
+			return fsckUnknownRecipients
+		case codes.MacMismatch:
+			return fsckMacMismatch
+		case codes.ErrorDecryptingTree:
+			return fsckDecryptError
+		}
+	}
+	return fsckParseError
+}
+
+// fsck decrypts secret files of all commits reachable from revs,
+// or from all refs. Each blob is checked once and reported with
+// the first commit it was found in.
+func (a *action) fsck(revs []string, asJSON bool) error {
+	checker, err := a.newSecretChecker()
+	if err != nil {
+		return err
+	}
+	checker.decrypt = true
+
+	revList := []string{"git", "rev-list", "--all"}
+	if len(revs) > 0 {
+		revList = append([]string{"git", "rev-list"}, revs...)
+	}
+	out, err := execArgs(revList, false, nil)
+	if err != nil {
+		return errors.Wrap(err, "list commits")
+	}
+	commits := strings.Fields(out)
+
+	enc := json.NewEncoder(os.Stdout)
+	reported := map[plumbing.Hash]bool{}
+	for _, line := range commits {
+		problems, err := checker.checkCommit(plumbing.NewHash(line))
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			if reported[p.blob] {
+				continue
+			}
+			reported[p.blob] = true
+			kind := problemKind(p.err)
+			if !asJSON {
+				fmt.Printf("%s %s %s: %s: %v\n",
+					shortHash(p.blob), shortHash(p.commit), p.path, kind, p.err)
+				continue
+			}
+			err := enc.Encode(fsckProblem{
+				Blob:    p.blob.String(),
+				Commit:  p.commit.String(),
+				Path:    p.path,
+				Problem: kind,
+				Error:   p.err.Error(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Infof("checked %d blobs in %d commits, %d problems",
+		len(checker.checked), len(commits), len(reported))
+	if len(reported) > 0 {
+		return errFsck
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package git
+
+import (
+	"testing"
+
+	"go.mozilla.org/sops/v3/cmd/sops/codes"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/stores"
+
+	"github.com/pkg/errors"
+)
+
+func TestProblemKind(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errNotEncrypted, fsckNotEncrypted},
+		{errNoRecipients, fsckNoRecipients},
+		{errors.Wrap(errNoRecipients, "s.yaml"), fsckNoRecipients},
+		{errNoMAC, fsckNoMAC},
+		{common.NewExitError("no key", codes.CouldNotRetrieveKey), fsckUnknownRecipients},
+		{common.NewExitError("mac", codes.MacMismatch), fsckMacMismatch},
+		{common.NewExitError("tree", codes.ErrorDecryptingTree), fsckDecryptError},
+		{stores.ErrConflict, fsckParseError},
+	}
+	for _, tt := range tests {
+		if got := problemKind(tt.err); got != tt.want {
+			t.Errorf("problemKind(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/go-git/go-git/v5"
@@ -22,6 +23,7 @@ var (
 	errIsDirty  = errors.New("please commit all modified files")
 	errRebasing = errors.New("please finish rebasing")
 	errNoBranch = errors.New("not on branch")
+	errBareRepo = errors.New("repository has no worktree")
 )
 
 var zeroHash = plumbing.ZeroHash
@@ -35,16 +37,28 @@ func (a *action) getGit() error {
 		return err
 	}
 	opt := &git.PlainOpenOptions{DetectDotGit: true}
-	if a.r, err = git.PlainOpenWithOptions(curDir, opt); err != nil {
-		return err
+	a.r, err = git.PlainOpenWithOptions(curDir, opt)
+	if err == git.ErrRepositoryNotExists {
+		// detection looks for .git only, try bare repository
+		a.r, err = git.PlainOpen(curDir)
 	}
-	if a.w, err = a.r.Worktree(); err != nil {
+	if err != nil {
 		return err
 	}
 	var ok bool
 	if a.s, ok = a.r.Storer.(*filesystem.Storage); !ok {
 		return fmt.Errorf("invalid git repository")
 	}
+	a.w, err = a.r.Worktree()
+	if err == git.ErrIsBareRepository {
+		// server hooks run in bare repositories
+		a.w = nil
+		a.d = a.s.Filesystem().Root()
+		return os.Chdir(a.d)
+	}
+	if err != nil {
+		return err
+	}
 	a.d = a.w.Filesystem.Root()
 	return os.Chdir(a.d)
 }
@@ -63,13 +77,15 @@ func (a *action) getState() (branch string, hash plumbing.Hash, encrypted bool,
 	hash = head.Hash()
 	rebasing := false
 	ref := head.Name()
+	policy := ""
 	if !ref.IsBranch() {
-		buf, err := ioutil.ReadFile(a.dotGit("rebase-merge", "head-name"))
-		ref = plumbing.ReferenceName(strings.TrimSpace(string(buf)))
-		if err != nil || !ref.IsBranch() {
-			return "", zeroHash, false, errNoBranch
+		ref, rebasing, err = a.detachedBranch()
+		if err == errNoBranch {
+			ref, policy, err = a.detachedPolicy(hash)
+		}
+		if err != nil {
+			return "", zeroHash, false, err
 		}
-		rebasing = true
 	}
 	branch = strings.TrimPrefix(ref.String(), "refs/heads/")
 
@@ -77,9 +93,11 @@ func (a *action) getState() (branch string, hash plumbing.Hash, encrypted bool,
 	if configured, err = a.configGet("", "sops.configured"); err != nil {
 		return
 	}
-	var encrypt string
-	if encrypt, err = a.configGet(branch, "sops-encrypt"); err != nil {
-		return
+	encrypt := strconv.FormatBool(policy == detachedEncrypt)
+	if branch != "" {
+		if encrypt, err = a.configGet(branch, "sops-encrypt"); err != nil {
+			return
+		}
 	}
 	switch os.Getenv(envFiltering) {
 	case "1", "true", "encrypt":
@@ -99,6 +117,9 @@ func (a *action) getState() (branch string, hash plumbing.Hash, encrypted bool,
 // note: go-git will not honor .gitattributes and consequently
 //       can't check status correctly when repository is encrypted
 func (a *action) ensureClean(file string, quiet bool) (branch string, encrypted bool, err error) {
+	if a.w == nil {
+		return "", false, errBareRepo
+	}
 	rebase := false
 	branch, _, encrypted, err = a.getState()
 	if err == errRebasing {
@@ -108,7 +129,9 @@ func (a *action) ensureClean(file string, quiet bool) (branch string, encrypted
 	if err != nil {
 		return branch, encrypted, err
 	}
-	if !encrypted {
+	// worktree of legacy ivacrypt filter differs from index as well
+	legacy, _ := a.configGet("", "ivacrypt.configured")
+	if !encrypted && legacy != "true" {
 		// can use internal go-git's status
 		var status git.Status
 		status, err = a.w.Status()
@@ -163,14 +186,34 @@ func (a *action) readIndexFile(path string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	entry, err := idx.Entry(path)
-	if err == index.ErrEntryNotFound {
-		err = errNotFound
+	entry := indexEntry(idx, path, mergedStages...)
+	if entry == nil {
+		return nil, errNotFound
 	}
-	if err != nil {
-		return nil, err
+	return a.readBlob(entry.Hash)
+}
+
+// stageMerged is the normal stage, go-git v5 defines index.Merged as 1
+const stageMerged index.Stage = 0
+
+// mergedStages prefer our side of unmerged path and then the ancestor,
+// so that resolved conflicts are encrypted with the current data key
+var mergedStages = []index.Stage{stageMerged, index.OurMode, index.AncestorMode, index.TheirMode}
+
+// indexEntry finds path entry of the first present stage
+func indexEntry(idx *index.Index, path string, stages ...index.Stage) *index.Entry {
+	for _, stage := range stages {
+		for _, entry := range idx.Entries {
+			if entry.Name == path && entry.Stage == stage {
+				return entry
+			}
+		}
 	}
-	blob, err := a.r.BlobObject(entry.Hash)
+	return nil
+}
+
+func (a *action) readBlob(hash plumbing.Hash) ([]byte, error) {
+	blob, err := a.r.BlobObject(hash)
 	if err != nil {
 		return nil, err
 	}
@@ -259,27 +302,50 @@ func (a *action) writeGitBlob(data []byte) (plumbing.Hash, error) {
 	return o.Hash(), nil
 }
 
-func (a *action) commitLog() ([]plumbing.Hash, error) {
-	headRef, err := a.r.Head()
-	if err != nil {
-		return nil, err
+// topoSort walks the commit graph from given tips depth-first
+// and emits commits in post-order, parents before children
+func (a *action) topoSort(tips []plumbing.Hash) ([]plumbing.Hash, error) {
+	type frame struct {
+		hash    plumbing.Hash
+		parents []plumbing.Hash
+		next    int
 	}
-	var revCommits []*object.Commit
-	branchIter, err := a.r.Log(&git.LogOptions{From: headRef.Hash()})
-	if err != nil {
-		return nil, err
-	}
-	err = branchIter.ForEach(func(c *object.Commit) error {
-		revCommits = append(revCommits, c)
+	var (
+		hashes []plumbing.Hash
+		stack  []*frame
+	)
+	seen := map[plumbing.Hash]bool{}
+	push := func(hash plumbing.Hash) error {
+		seen[hash] = true
+		commit, err := a.r.CommitObject(hash)
+		if err != nil {
+			return errors.Wrapf(err, "get commit %s", shortHash(hash))
+		}
+		stack = append(stack, &frame{hash: hash, parents: commit.ParentHashes})
 		return nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	n1 := len(revCommits) - 1
-	var hashes []plumbing.Hash
-	for i := 0; i <= n1; i++ {
-		hashes = append(hashes, revCommits[n1-i].Hash)
+	for _, tip := range tips {
+		if seen[tip] {
+			continue
+		}
+		if err := push(tip); err != nil {
+			return nil, err
+		}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.next < len(top.parents) {
+				dad := top.parents[top.next]
+				top.next++
+				if !seen[dad] {
+					if err := push(dad); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			hashes = append(hashes, top.hash)
+			stack = stack[:len(stack)-1]
+		}
 	}
 	return hashes, nil
 }
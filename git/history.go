@@ -0,0 +1,113 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/pkg/errors"
+)
+
+// historyMap pairs plain commits with their encrypted counterparts
+// translated by previous runs, so that the next run in either direction
+// rewrites only new commits. It lives in .git/sops/map as lines of
+//
+//	<plain> <encrypted>
+//
+// where later lines override earlier ones.
+type historyMap struct {
+	path      string
+	encrypted map[plumbing.Hash]plumbing.Hash // plain -> encrypted
+	plain     map[plumbing.Hash]plumbing.Hash // encrypted -> plain
+}
+
+// newHistoryMap returns empty map, new pairs will override saved ones
+func (a *action) newHistoryMap() *historyMap {
+	return &historyMap{
+		path:      a.dotGit("sops", "map"),
+		encrypted: map[plumbing.Hash]plumbing.Hash{},
+		plain:     map[plumbing.Hash]plumbing.Hash{},
+	}
+}
+
+// loadHistoryMap reads commit pairs of previous runs, if any
+func (a *action) loadHistoryMap() (*historyMap, error) {
+	m := a.newHistoryMap()
+	file, err := os.Open(m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open history map")
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			log.Debugf("history map line %d skipped: %q", lineNo, scanner.Text())
+			continue
+		}
+		m.add(plumbing.NewHash(fields[0]), plumbing.NewHash(fields[1]))
+	}
+	return m, errors.Wrap(scanner.Err(), "read history map")
+}
+
+func (m *historyMap) add(plainHash, encHash plumbing.Hash) {
+	m.encrypted[plainHash] = encHash
+	m.plain[encHash] = plainHash
+}
+
+// lookup returns translation of a commit in given direction
+func (m *historyMap) lookup(hash plumbing.Hash, encrypt bool) (plumbing.Hash, bool) {
+	if encrypt {
+		newHash, ok := m.encrypted[hash]
+		return newHash, ok
+	}
+	newHash, ok := m.plain[hash]
+	return newHash, ok
+}
+
+// save appends new commit pairs of a finished run
+func (m *historyMap) save(commitMap map[plumbing.Hash]plumbing.Hash, encrypt bool) error {
+	if err := os.MkdirAll(filepath.Dir(m.path), permSecretDir); err != nil {
+		return errors.Wrap(err, "create history map directory")
+	}
+	file, err := os.OpenFile(m.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, permSecret)
+	if err != nil {
+		return errors.Wrap(err, "open history map")
+	}
+	w := bufio.NewWriter(file)
+	for oldHash, newHash := range commitMap {
+		if known, ok := m.lookup(oldHash, encrypt); ok && known == newHash {
+			continue
+		}
+		plainHash, encHash := oldHash, newHash
+		if !encrypt {
+			plainHash, encHash = newHash, oldHash
+		}
+		m.add(plainHash, encHash)
+		_, _ = fmt.Fprintf(w, "%s %s\n", plainHash, encHash)
+	}
+	err = w.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.Wrap(err, "write history map")
+}
+
+// remap points pairs of encrypted commits rewritten by revocation at their
+// new counterparts, so that later runs won't bring the old ones back
+func (m *historyMap) remap(commitMap map[plumbing.Hash]plumbing.Hash) error {
+	pairs := map[plumbing.Hash]plumbing.Hash{}
+	for oldHash, newHash := range commitMap {
+		if plainHash, ok := m.plain[oldHash]; ok && oldHash != newHash {
+			pairs[plainHash] = newHash
+		}
+	}
+	return m.save(pairs, true)
+}
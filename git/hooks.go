@@ -0,0 +1,63 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const hookMarker = "# installed by git-sops"
+
+// gitHooks are installed by setup
+var gitHooks = []string{"pre-push"}
+
+// hookPath honors core.hooksPath
+func (a *action) hookPath(name string) string {
+	dir, _ := a.configGet("", "core.hooksPath")
+	if dir == "" {
+		return a.dotGit("hooks", name)
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(a.d, dir)
+	}
+	return filepath.Join(dir, name)
+}
+
+// installHooks makes git run the program as hooks, foreign hooks are kept
+func (a *action) installHooks(program string) error {
+	for _, name := range gitHooks {
+		path := a.hookPath(name)
+		if data, err := ioutil.ReadFile(path); err == nil && !strings.Contains(string(data), hookMarker) {
+			log.Warnf("%s hook exists, please add to it: %s %s \"$@\"", name, shellQuote(program), name)
+			continue
+		}
+		script := fmt.Sprintf("#!/bin/sh\n%s\nexec %s %s \"$@\"\n", hookMarker, shellQuote(program), name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return errors.Wrap(err, "create hooks directory")
+		}
+		if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+			return errors.Wrapf(err, "install %s hook", name)
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes the string for /bin/sh, single quotes
+// prevent any expansion, quotes inside are spliced in
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// removeHooks deletes hooks installed by setup
+func (a *action) removeHooks() {
+	for _, name := range gitHooks {
+		path := a.hookPath(name)
+		if data, err := ioutil.ReadFile(path); err == nil && strings.Contains(string(data), hookMarker) {
+			_ = os.Remove(path)
+		}
+	}
+}
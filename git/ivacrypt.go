@@ -0,0 +1,220 @@
+package git
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/pkg/errors"
+)
+
+// settings of the legacy cryptor.sh filter
+const (
+	ivacryptDriver   = "crypt"
+	ivacryptSections = "ivacrypt filter.crypt diff.crypt merge.crypt"
+	ivacryptAliases  = "ls-crypt chmod-crypt branch-encrypted branch-decrypted ls-blobs crypt"
+	ivacryptNoPush   = "ivacrypt-push-disabled"
+	ivacryptPrefix   = "U2FsdGVk" // "Salted" in base64
+	ivacryptMagic    = "Salted__"
+)
+
+var (
+	ivacryptCipherRe = regexp.MustCompile(`^aes-?(128|192|256)(?:-(cbc|ctr|cfb|ofb))?$`)
+	ivacryptAttrRe   = regexp.MustCompile(`(?m)\b(filter|diff|merge)=` + ivacryptDriver + `([ \t\r]|$)`)
+)
+
+// ivacrypt decrypts files encrypted by cryptor.sh with
+// "openssl enc -<cipher> -md MD5 -a [-iter N]"
+type ivacrypt struct {
+	keyLen   int
+	mode     string
+	password []byte
+	iter     int // PBKDF2 iterations, zero for EVP_BytesToKey
+}
+
+func newIvacrypt(cipherName, password string, iter int) (*ivacrypt, error) {
+	m := ivacryptCipherRe.FindStringSubmatch(strings.ToLower(cipherName))
+	if m == nil {
+		return nil, fmt.Errorf("unsupported ivacrypt cipher %q", cipherName)
+	}
+	bits, _ := strconv.Atoi(m[1])
+	c := &ivacrypt{
+		keyLen:   bits / 8,
+		mode:     m[2],
+		password: []byte(password),
+		iter:     iter,
+	}
+	if c.mode == "" {
+		c.mode = "cbc" // aes256 is an alias of aes-256-cbc
+	}
+	return c, nil
+}
+
+// deriveKey computes key and IV like openssl enc does
+func (c *ivacrypt) deriveKey(salt []byte) (key, iv []byte) {
+	size := c.keyLen + aes.BlockSize
+	var buf []byte
+	if c.iter > 0 {
+		buf = pbkdf2.Key(c.password, salt, c.iter, size, md5.New)
+	} else {
+		// EVP_BytesToKey with one round
+		var digest []byte
+		for len(buf) < size {
+			h := md5.New()
+			h.Write(digest)
+			h.Write(c.password)
+			h.Write(salt)
+			digest = h.Sum(nil)
+			buf = append(buf, digest...)
+		}
+	}
+	return buf[:c.keyLen], buf[c.keyLen:size]
+}
+
+// decrypt decodes a salted blob, data without the salt header
+// is returned as is like cryptor.sh does it for plain files
+func (c *ivacrypt) decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(ivacryptPrefix)) {
+		return data, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "decode base64")
+	}
+	if len(raw) < 16 || string(raw[:8]) != ivacryptMagic {
+		return nil, errors.New("no salt header")
+	}
+	key, iv := c.deriveKey(raw[8:16])
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	src := raw[16:]
+	out := make([]byte, len(src))
+	switch c.mode {
+	case "cbc":
+		if len(src)%aes.BlockSize != 0 {
+			return nil, errors.New("bad decrypt: truncated data")
+		}
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, src)
+		pad := 0
+		if len(out) > 0 {
+			pad = int(out[len(out)-1])
+		}
+		if pad == 0 || pad > aes.BlockSize || pad > len(out) ||
+			!bytes.Equal(out[len(out)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+			return nil, errors.New("bad decrypt: wrong password or cipher")
+		}
+		out = out[:len(out)-pad]
+	case "ctr":
+		cipher.NewCTR(block, iv).XORKeyStream(out, src)
+	case "cfb":
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(out, src)
+	case "ofb":
+		cipher.NewOFB(block, iv).XORKeyStream(out, src)
+	}
+	return out, nil
+}
+
+// rewriteAttrs switches crypt drivers of gitattributes to sops
+func rewriteAttrs(data []byte) []byte {
+	return ivacryptAttrRe.ReplaceAll(data, []byte("${1}="+gitDriver+"${2}"))
+}
+
+// matchIvacrypt lists files under crypt filter at the location along
+// with gitattributes which assign it
+func (a *action) matchIvacrypt(loc string) ([]string, error) {
+	allFiles, err := a.allFiles(loc)
+	if err != nil {
+		return nil, err
+	}
+	files, err := a.matchDriver(allFiles, loc, ivacryptDriver)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, filterAttrFiles(allFiles)...)
+	sort.Strings(files)
+	return files, nil
+}
+
+// importIvacrypt rewrites all branches and tags encrypted by cryptor.sh
+// into sops documents, then removes the legacy filter from git config
+func (a *action) importIvacrypt(iter int, topts transformOpts) error {
+	configured, _ := a.configGet("", "sops.configured")
+	if configured != "true" {
+		return errors.New("repository is not configured, run setup first")
+	}
+	cipherName, _ := a.configGet("", "ivacrypt.cipher")
+	password, _ := a.configGet("", "ivacrypt.password")
+	if cipherName == "" || password == "" {
+		return errors.New("ivacrypt cipher or password is not configured")
+	}
+	c, err := newIvacrypt(cipherName, password, iter)
+	if err != nil {
+		return err
+	}
+	topts.ivacrypt = c
+	topts.all = true
+	if err := a.transformBranch("", true, topts); err != nil {
+		return err
+	}
+	return a.removeIvacrypt()
+}
+
+// removeIvacrypt drops settings of cryptor.sh including merge.renormalize
+// and restores branch remotes it has disabled
+func (a *action) removeIvacrypt() error {
+	// go-git saves branch remotes from parsed config, not from raw options
+	cfg, err := a.r.Config()
+	if err != nil {
+		return err
+	}
+	for _, branch := range cfg.Branches {
+		raw := cfg.Raw.Section("branch").Subsection(branch.Name)
+		if branch.Remote == ivacryptNoPush {
+			branch.Remote = raw.Option("ivacrypt-saved-remote")
+			if branch.Remote == ivacryptNoPush {
+				branch.Remote = ""
+			}
+		}
+		raw.RemoveOption("ivacrypt-saved-remote")
+		raw.RemoveOption("ivacrypt-status")
+	}
+	if err := a.r.SetConfig(cfg); err != nil {
+		return err
+	}
+
+	// go on after failures, then report all of them
+	var failed []string
+	check := func(err error, what string) {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", what, err))
+		}
+	}
+	for _, section := range strings.Split(ivacryptSections, " ") {
+		check(a.removeSection(section), section)
+	}
+	for _, alias := range strings.Split(ivacryptAliases, " ") {
+		check(a.configUnset("", "alias."+alias), "alias."+alias)
+	}
+	check(a.configUnset("", "merge.renormalize"), "merge.renormalize")
+	notes := plumbing.ReferenceName("refs/notes/textconv/" + ivacryptDriver)
+	check(a.s.RemoveReference(notes), notes.String())
+	check(os.RemoveAll(a.dotGit("ivacrypt")), "ivacrypt directory")
+	if len(failed) > 0 {
+		return fmt.Errorf("cannot remove ivacrypt configuration: %s", strings.Join(failed, "; "))
+	}
+	fmt.Println("ivacrypt configuration removed")
+	return nil
+}
@@ -0,0 +1,66 @@
+package git
+
+import (
+	"testing"
+)
+
+func TestIvacryptDecrypt(t *testing.T) {
+	const (
+		plain = "token: abc\n"
+		long  = "a longer line of text to span more than one base64 line of sixty four chars\n"
+	)
+	tests := []struct {
+		cipher string
+		iter   int
+		input  string
+		output string
+		fails  bool
+	}{
+		{"aes-256-cbc", 0, "U2FsdGVkX1+aT+6Iz6cYj0kyTNjCFmBb/z04eHn8pvo=\n", plain, false},
+		{"aes256", 0, "U2FsdGVkX1+aT+6Iz6cYj0kyTNjCFmBb/z04eHn8pvo=\n", plain, false},
+		{"aes-128-ctr", 0, "U2FsdGVkX1/AMu4+KSzdObBZ6SXIowcIs9Sh\n", plain, false},
+		{"aes-192-cfb", 0, "U2FsdGVkX1/zT+yx0q9oBEgs80flk9AHNmpg\n", plain, false},
+		{"aes-256-ofb", 0, "U2FsdGVkX1+J6EtDDWpCIUENbE7UcWSlAaoJ\n", plain, false},
+		{"aes-256-cbc", 1000, "U2FsdGVkX19X2oAZshQr8o2j5wPdB7fEO+I0ExfeKLY=\n", plain, false},
+		{"aes-128-cbc", 0, "U2FsdGVkX1/L5WWNiXWOGpjwRDY9sj1krFUfgkLYg3QOElxKnAeJ2xgUi+wQS0UQ\n" +
+			"GAiBa2JuZGPl2gNaEE0uMZj6GZ85x37Hrv7f+9hi3gPdHPvcOuvo3sMgmq7FkB+E\n", long, false},
+		{"aes-256-cbc", 0, plain, plain, false},
+		{"aes-256-cbc", 1000, "U2FsdGVkX1+aT+6Iz6cYj0kyTNjCFmBb/z04eHn8pvo=\n", "", true},
+		{"aes-256-cbc", 0, "U2FsdGVk!!\n", "", true},
+	}
+	for _, tc := range tests {
+		c, err := newIvacrypt(tc.cipher, "secret", tc.iter)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.cipher, err)
+		}
+		output, err := c.decrypt([]byte(tc.input))
+		if tc.fails {
+			if err == nil {
+				t.Errorf("%s/%d %q: expected error", tc.cipher, tc.iter, tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s/%d %q: %v", tc.cipher, tc.iter, tc.input, err)
+		} else if string(output) != tc.output {
+			t.Errorf("%s/%d %q: expected %q, got %q", tc.cipher, tc.iter, tc.input, tc.output, output)
+		}
+	}
+	if _, err := newIvacrypt("des3", "secret", 0); err == nil {
+		t.Error("des3: expected unsupported cipher")
+	}
+}
+
+func TestRewriteAttrs(t *testing.T) {
+	input := "*.key filter=crypt diff=crypt merge=crypt\n" +
+		"*.txt filter=crypted\n" +
+		"*.env\tfilter=crypt\r\n" +
+		"*.bin -diff\n"
+	expected := "*.key filter=sops diff=sops merge=sops\n" +
+		"*.txt filter=crypted\n" +
+		"*.env\tfilter=sops\r\n" +
+		"*.bin -diff\n"
+	if output := string(rewriteAttrs([]byte(input))); output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+}
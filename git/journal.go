@@ -0,0 +1,204 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/pkg/errors"
+)
+
+var errNoJournal = errors.New("no interrupted transformation to resume")
+
+const journalVersion = "sops-transform-v1"
+
+// journal records commits and blobs translated by history transformation,
+// so that an interrupted run can be resumed. It lives in .git/sops/transform:
+//
+//	sops-transform-v1 <encrypt|decrypt|revoke:recipient> <head> <branch>
+//	blob <old> <new> <quoted-path>
+//	commit <old> <new>
+type journal struct {
+	path      string
+	file      *os.File
+	w         *bufio.Writer
+	direction string
+	head      plumbing.Hash
+	branch    string
+	commits   map[plumbing.Hash]plumbing.Hash
+	blobs     map[transKey]plumbing.Hash
+}
+
+func (a *action) journalPath() string {
+	return a.dotGit("sops", "transform")
+}
+
+// createJournal starts a new journal replacing the stale one
+func (a *action) createJournal(direction string, head plumbing.Hash, branch string) (*journal, error) {
+	j := &journal{
+		path:      a.journalPath(),
+		direction: direction,
+		head:      head,
+		branch:    branch,
+		commits:   map[plumbing.Hash]plumbing.Hash{},
+		blobs:     map[transKey]plumbing.Hash{},
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), permSecretDir); err != nil {
+		return nil, errors.Wrap(err, "create journal directory")
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, permSecret)
+	if err != nil {
+		return nil, errors.Wrap(err, "create journal")
+	}
+	j.file = file
+	j.w = bufio.NewWriter(file)
+	_, _ = fmt.Fprintf(j.w, "%s %s %s %s\n",
+		journalVersion, direction, head, branch)
+	if err := j.flush(); err != nil {
+		j.close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// loadJournal reads the journal of interrupted transformation and opens
+// it for appending, entries pointing at missing objects are dropped
+func (a *action) loadJournal() (*journal, error) {
+	j := &journal{
+		path:    a.journalPath(),
+		commits: map[plumbing.Hash]plumbing.Hash{},
+		blobs:   map[transKey]plumbing.Hash{},
+	}
+	file, err := os.OpenFile(j.path, os.O_RDWR|os.O_APPEND, permSecret)
+	if os.IsNotExist(err) {
+		return nil, errNoJournal
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "open journal")
+	}
+	exists := func(hash plumbing.Hash) bool {
+		return a.s.HasEncodedObject(hash) == nil
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.SplitN(scanner.Text(), " ", 4)
+		switch {
+		case lineNo == 1 && len(fields) == 4 && fields[0] == journalVersion:
+			j.direction = fields[1]
+			j.head = plumbing.NewHash(fields[2])
+			j.branch = fields[3]
+		case lineNo == 1:
+			err = errors.New("invalid header")
+		case len(fields) == 3 && fields[0] == "commit":
+			oldHash, newHash := plumbing.NewHash(fields[1]), plumbing.NewHash(fields[2])
+			if exists(newHash) {
+				j.commits[oldHash] = newHash
+			}
+		case len(fields) == 4 && fields[0] == "blob":
+			var path string
+			if path, err = strconv.Unquote(fields[3]); err != nil {
+				break
+			}
+			key := transKey{path: path, hash: plumbing.NewHash(fields[1])}
+			if newHash := plumbing.NewHash(fields[2]); exists(newHash) {
+				j.blobs[key] = newHash
+			}
+		default:
+			// the last line may be cut short by a crash
+			log.Debugf("journal line %d skipped: %q", lineNo, scanner.Text())
+		}
+		if err != nil {
+			_ = file.Close()
+			return nil, errors.Wrapf(err, "parse journal line %d", lineNo)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		_ = file.Close()
+		return nil, errors.Wrap(err, "read journal")
+	}
+	j.file = file
+	j.w = bufio.NewWriter(file)
+	// make sure that new entries start on a new line
+	_, _ = j.w.WriteString("\n")
+	return j, nil
+}
+
+// resumeJournal loads journal of interrupted transformation in the same
+// direction. If the run was killed on its temporary branch, HEAD is moved
+// back to the original branch which points at the same commit.
+func (a *action) resumeJournal(direction string) (*journal, error) {
+	j, err := a.loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	if j.direction != direction {
+		j.close()
+		return nil, fmt.Errorf("interrupted transformation was to %s", j.direction)
+	}
+	head, err := a.r.Head()
+	if err != nil {
+		j.close()
+		return nil, err
+	}
+	if tmpBranch := head.Name().Short(); head.Name().IsBranch() &&
+		strings.HasPrefix(tmpBranch, j.branch+"-SOPS-") && head.Hash() == j.head {
+		ref := plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(j.branch))
+		if err = a.s.SetReference(ref); err == nil {
+			err = a.deleteBranch(tmpBranch, true)
+		}
+		if err != nil {
+			j.close()
+			return nil, errors.Wrapf(err, "leave temporary branch %s", tmpBranch)
+		}
+		log.Infof("left temporary branch %s for %s", tmpBranch, j.branch)
+	}
+	return j, nil
+}
+
+func (j *journal) addBlob(key transKey, newHash plumbing.Hash) {
+	j.blobs[key] = newHash
+	_, _ = fmt.Fprintf(j.w, "blob %s %s %s\n", key.hash, newHash, strconv.Quote(key.path))
+}
+
+// addCommit records translated commit and flushes preceding blob entries
+func (j *journal) addCommit(oldHash, newHash plumbing.Hash) error {
+	j.commits[oldHash] = newHash
+	_, _ = fmt.Fprintf(j.w, "commit %s %s\n", oldHash, newHash)
+	return j.flush()
+}
+
+func (j *journal) flush() error {
+	if err := j.w.Flush(); err != nil {
+		return errors.Wrap(err, "write journal")
+	}
+	return errors.Wrap(j.file.Sync(), "sync journal")
+}
+
+func (j *journal) close() {
+	if j.file != nil {
+		_ = j.w.Flush()
+		_ = j.file.Close()
+		j.file = nil
+	}
+}
+
+// remove deletes journal after successful transformation
+func (j *journal) remove() error {
+	j.close()
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func directionName(encrypt bool) string {
+	if encrypt {
+		return "encrypt"
+	}
+	return "decrypt"
+}
@@ -5,20 +5,17 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
-	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
 	"github.com/go-git/go-git/v5/plumbing/object"
 
 	"github.com/pkg/errors"
 )
 
-// TODO Handle .gitattributes in subdirectories
-const gitAttrFileName = ".gitattributes"
-
 func (a *action) listFiles(staged bool) error {
 	loc := "worktree"
 	if staged {
@@ -60,10 +57,22 @@ func (a *action) smudgeFiles(files []string) error {
 		input, err := a.readIndexFile(path)
 		output := input
 		if err == nil && len(input) > 0 {
-			opts := baseOpts.forPath(path)
+			var opts *options
+			if opts, err = baseOpts.forPath(path); err != nil {
+				return err
+			}
 			opts.inputData = input
+			opts.trackLocked = true
 			output, err = a.sopsDecrypt(opts)
-			if isMetaNotFound(err, path) {
+			switch {
+			case isMetaNotFound(err):
+				output = input
+				err = nil
+			case err == nil:
+				a.trackLocked(opts, false)
+			case opts.noKey && isKeyMissing(err):
+				log.Debugf("%s: no key, left encrypted", path)
+				a.trackLocked(opts, true)
 				output = input
 				err = nil
 			}
@@ -89,38 +98,15 @@ func (a *action) matchWorktree(files []string) ([]string, error) {
 }
 
 func (a *action) matchFiles(loc string) ([]string, error) {
-	data, err := a.readGitFile(gitAttrFileName, loc)
-	if errors.Cause(err) == errNotFound {
-		log.Debugf("gitattributes not found in %s", shortLoc(loc))
-		return nil, nil
-	}
+	allFiles, err := a.allFiles(loc)
 	if err != nil {
-		return nil, errors.Wrapf(err, "read gitattributes from %s", shortLoc(loc))
-	}
-	text := string(data)
-
-	// FIXME dirty hacks to workaround for lack of "[x-y] [abc]" syntax in go-git
-	text = strings.ReplaceAll(text, "[0-9]", "*")
-	text = strings.ReplaceAll(text, "[.-]secret", "-secret")
-	text = strings.ReplaceAll(text, "secret[.-]", "secret.")
-	//log.Debugf("fixed gitattributes:\n%s", text)
-
-	matchAttrs, err := gitattributes.ReadAttributes(strings.NewReader(text), nil, true)
-	if err != nil {
-		return nil, errors.Wrap(err, "parse gitattributes")
-	}
-
-	var patterns []gitattributes.Pattern
-	for _, m := range matchAttrs {
-		if isOurMatch(m) {
-			patterns = append(patterns, m.Pattern)
-			//log.Debugf("our pattern: %#v", m.Pattern)
-		}
-	}
-	if len(patterns) == 0 {
-		return nil, nil
+		return nil, err
 	}
+	return a.matchDriver(allFiles, loc, gitDriver)
+}
 
+// allFiles lists files of the index, worktree or commit
+func (a *action) allFiles(loc string) ([]string, error) {
 	var allFiles []string
 	switch loc {
 	case "index":
@@ -134,9 +120,9 @@ func (a *action) matchFiles(loc string) ([]string, error) {
 			}
 		}
 	case "worktree":
-		err = a.walkDir("", false, func(path string, fi os.FileInfo) {
+		err := a.walkDir("", false, func(path string, fi os.FileInfo) {
 			if !fi.IsDir() {
-				allFiles = append(allFiles, path)
+				allFiles = append(allFiles, filepath.ToSlash(path))
 			}
 		})
 		if err != nil {
@@ -168,16 +154,24 @@ func (a *action) matchFiles(loc string) ([]string, error) {
 	}
 	sort.Strings(allFiles)
 	log.Debugf("all files in %s: %s", shortLoc(loc), allFiles)
+	return allFiles, nil
+}
+
+// matchDriver picks files which gitattributes at the location
+// assign to the filter driver
+func (a *action) matchDriver(allFiles []string, loc, driver string) ([]string, error) {
+	rules, err := a.readAttrRules(allFiles, loc, driver)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
 
 	var files []string
 	for _, path := range allFiles {
-		splitPath := strings.Split(path, "/")
-		for _, p := range patterns {
-			if p.Match(splitPath) {
-				files = append(files, path)
-				//log.Debugf("%s matched %#v", path, p)
-				break
-			}
+		if matchAttrRules(rules, strings.Split(path, "/")) {
+			files = append(files, path)
 		}
 	}
 	sort.Strings(files)
@@ -185,12 +179,3 @@ func (a *action) matchFiles(loc string) ([]string, error) {
 
 	return files, nil
 }
-
-func isOurMatch(m gitattributes.MatchAttribute) bool {
-	for _, a := range m.Attributes {
-		if a.Name() == "filter" && a.Value() == gitDriver {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,192 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"github.com/pkg/errors"
+)
+
+// lockedFileTimeout limits waiting for other processes updating the list
+const lockedFileTimeout = 5 * time.Second
+
+// lockedFiles are secret files which no-key mode has left encrypted
+// in the worktree since their data keys can't be retrieved. The list
+// lives in .git/sops/locked as lines of
+//
+//	<blob> <path>
+//
+// so that clean filter can pass these blobs through unchanged.
+type lockedFiles struct {
+	mu    sync.Mutex
+	blobs map[string]plumbing.Hash // nil until loaded
+}
+
+func (a *action) lockedPath() string {
+	return a.dotGit("sops", "locked")
+}
+
+// loadLocked reads the list once per process unless reload is requested,
+// the caller holds the lock
+func (a *action) loadLocked(reload bool) error {
+	if a.locked.blobs != nil && !reload {
+		return nil
+	}
+	a.locked.blobs = map[string]plumbing.Hash{}
+	file, err := os.Open(a.lockedPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open locked files")
+	}
+	defer func() { _ = file.Close() }()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if sp := strings.IndexByte(line, ' '); sp > 0 {
+			a.locked.blobs[line[sp+1:]] = plumbing.NewHash(line[:sp])
+		}
+	}
+	return errors.Wrap(scanner.Err(), "read locked files")
+}
+
+// saveLocked rewrites the list, the caller holds the locks
+func (a *action) saveLocked() error {
+	path := a.lockedPath()
+	if len(a.locked.blobs) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove locked files")
+		}
+		return nil
+	}
+	var lines []string
+	for name, hash := range a.locked.blobs {
+		lines = append(lines, fmt.Sprintf("%s %s\n", hash, name))
+	}
+	sort.Strings(lines)
+	if err := os.MkdirAll(filepath.Dir(path), permSecretDir); err != nil {
+		return errors.Wrap(err, "create locked files directory")
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "locked.*.tmp")
+	if err != nil {
+		return errors.Wrap(err, "write locked files")
+	}
+	_, err = tmp.WriteString(strings.Join(lines, ""))
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return errors.Wrap(err, "write locked files")
+}
+
+// lockLockedFile takes the lock file of the list as git does, so that
+// filters and commands of other processes don't lose updates
+func (a *action) lockLockedFile() (unlock func(), err error) {
+	path := a.lockedPath() + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), permSecretDir); err != nil {
+		return nil, errors.Wrap(err, "create locked files directory")
+	}
+	deadline := time.Now().Add(lockedFileTimeout)
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, permSecret)
+		if err == nil {
+			_ = file.Close()
+			return func() { _ = os.Remove(path) }, nil
+		}
+		if !os.IsExist(err) || time.Now().After(deadline) {
+			return nil, errors.Wrapf(err, "lock locked files, remove %s if no other git-sops is running", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setLocked records that the worktree file keeps encrypted data,
+// or that it's decrypted now
+func (a *action) setLocked(path string, data []byte, locked bool) error {
+	a.locked.mu.Lock()
+	defer a.locked.mu.Unlock()
+	unlock, err := a.lockLockedFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := a.loadLocked(true); err != nil {
+		return err
+	}
+	hash := plumbing.ComputeHash(plumbing.BlobObject, data)
+	old, found := a.locked.blobs[path]
+	switch {
+	case locked && found && old == hash:
+		return nil
+	case locked:
+		a.locked.blobs[path] = hash
+	case !found:
+		return nil
+	default:
+		delete(a.locked.blobs, path)
+	}
+	return a.saveLocked()
+}
+
+// isLocked tells whether the data is the blob left encrypted at the path
+func (a *action) isLocked(path string, data []byte) bool {
+	a.locked.mu.Lock()
+	defer a.locked.mu.Unlock()
+	if err := a.loadLocked(false); err != nil {
+		log.Warnf("%v", err)
+		return false
+	}
+	hash, found := a.locked.blobs[path]
+	return found && hash == plumbing.ComputeHash(plumbing.BlobObject, data)
+}
+
+// listLocked returns locked files still staged with the recorded
+// blobs, records of files replaced or removed since are dropped
+func (a *action) listLocked() ([]string, error) {
+	idx, err := a.s.Index()
+	if err != nil {
+		return nil, errors.Wrap(err, "grab index")
+	}
+	a.locked.mu.Lock()
+	defer a.locked.mu.Unlock()
+	unlock, err := a.lockLockedFile()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if err := a.loadLocked(true); err != nil {
+		return nil, err
+	}
+	var paths []string
+	pruned := false
+	for path, hash := range a.locked.blobs {
+		if entry := indexEntry(idx, path, stageMerged); entry == nil || entry.Hash != hash {
+			delete(a.locked.blobs, path)
+			pruned = true
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if pruned {
+		if err := a.saveLocked(); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,121 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+)
+
+func TestLockedFiles(t *testing.T) {
+	a, cleanup := testAction(t)
+	defer cleanup()
+	// another process working on the same repository
+	b := &action{c: a.c, r: a.r, s: a.s, w: a.w, d: a.d}
+
+	steps := []struct {
+		who    *action
+		path   string
+		data   string
+		locked bool
+	}{
+		{a, "a.yaml", "enc-a", true},
+		{b, "b.yaml", "enc-b", true},
+		{a, "c.yaml", "enc-c", true},
+		{a, "c.yaml", "enc-c", false},
+		{a, "d.yaml", "plain-d", false},
+	}
+	for _, s := range steps {
+		if err := s.who.setLocked(s.path, []byte(s.data), s.locked); err != nil {
+			t.Fatalf("setLocked(%s, %v): %v", s.path, s.locked, err)
+		}
+	}
+
+	c := &action{c: a.c, r: a.r, s: a.s, w: a.w, d: a.d}
+	checks := []struct {
+		path string
+		data string
+		want bool
+	}{
+		{"a.yaml", "enc-a", true},
+		{"a.yaml", "plain-a", false},
+		{"b.yaml", "enc-b", true},
+		{"c.yaml", "enc-c", false},
+		{"d.yaml", "plain-d", false},
+	}
+	for _, ch := range checks {
+		if got := c.isLocked(ch.path, []byte(ch.data)); got != ch.want {
+			t.Errorf("isLocked(%s, %q) = %v, want %v", ch.path, ch.data, got, ch.want)
+		}
+	}
+
+	// b.yaml has been replaced in the index, a.yaml is still there
+	idx := &index.Index{Version: 2, Entries: []*index.Entry{
+		{Name: "a.yaml", Hash: plumbing.ComputeHash(plumbing.BlobObject, []byte("enc-a"))},
+		{Name: "b.yaml", Hash: plumbing.ComputeHash(plumbing.BlobObject, []byte("new-b"))},
+	}}
+	if err := a.s.SetIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := c.listLocked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.yaml"}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("listLocked() = %v, want %v", paths, want)
+	}
+	d := &action{c: a.c, r: a.r, s: a.s, w: a.w, d: a.d}
+	if d.isLocked("b.yaml", []byte("enc-b")) {
+		t.Error("b.yaml record was not pruned")
+	}
+
+	if err := d.setLocked("a.yaml", []byte("enc-a"), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(d.lockedPath()); !os.IsNotExist(err) {
+		t.Errorf("locked files list left behind: %v", err)
+	}
+}
+
+func TestLockedConcurrent(t *testing.T) {
+	a, cleanup := testAction(t)
+	defer cleanup()
+
+	// actions stand for filter processes sharing the list
+	const workers, files = 4, 25
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		p := &action{c: a.c, r: a.r, s: a.s, w: a.w, d: a.d}
+		prefix := fmt.Sprintf("w%d", w)
+		go func() {
+			for i := 0; i < files; i++ {
+				path := fmt.Sprintf("%s/s%d.yaml", prefix, i)
+				if err := p.setLocked(path, []byte("enc-"+path), true); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &action{c: a.c, r: a.r, s: a.s, w: a.w, d: a.d}
+	for w := 0; w < workers; w++ {
+		for i := 0; i < files; i++ {
+			path := fmt.Sprintf("w%d/s%d.yaml", w, i)
+			if !c.isLocked(path, []byte("enc-"+path)) {
+				t.Errorf("%s record is lost", path)
+			}
+		}
+	}
+	if _, err := os.Stat(c.lockedPath() + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
@@ -1,11 +1,17 @@
 package git
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os/exec"
 
+	"github.com/go-git/go-git/v5/plumbing/format/index"
 	"github.com/pkg/errors"
 	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+	"go.mozilla.org/sops/v3/version"
 )
 
 func (a *action) mergeDriver(path, ancestor, current, other string) error {
@@ -37,7 +43,8 @@ func (a *action) mergeDriver(path, ancestor, current, other string) error {
 	}
 	log.Debugf("ancestor: %s current: %s other: %s", ancestor, current, other)
 
-	// decrypt merge sources
+	// decrypt merge sources, keep encrypted current side for conflicts
+	var encryptedCurrent []byte
 	for role, s := range sources {
 		log.Debugf("merge decrypting %s: %s", role, s.path)
 		input, err := ioutil.ReadFile(s.path)
@@ -47,33 +54,57 @@ func (a *action) mergeDriver(path, ancestor, current, other string) error {
 		if len(input) == 0 {
 			continue
 		}
-		opts := baseOpts.forPath(path)
+		opts, err := baseOpts.forPath(path)
+		if err != nil {
+			return err
+		}
 		opts.inputData = input
 		output, err := a.sopsDecrypt(opts)
-		if isMetaNotFound(err, path) {
+		if isMetaNotFound(err) {
 			continue
 		}
 		if err != nil {
 			return errors.Wrapf(err, "decrypting merged %s", role)
 		}
 		s.meta = &opts.meta
+		if role == "current" {
+			encryptedCurrent = input
+		}
 		err = overwriteFile(s.path, output, true)
 		if err != nil {
 			return errors.Wrapf(err, "writing decrypted %s to %s", role, s.path)
 		}
 	}
 
-	// perform 3-way merge
-	diffOpt := "--no-diff3"
-	if mergeStyle, _ := a.configGet("", "merge.conflictstyle"); mergeStyle == "diff3" {
-		diffOpt = "--diff3"
-	}
-	mergeCmd := `git merge-file -L CURRENT -L ANCESTOR -L OTHER %s "%s" "%s" "%s"`
-	mergeCmd = fmt.Sprintf(mergeCmd, diffOpt, current, ancestor, other)
-	mergeOut, err := execCommand(mergeCmd, true, nil)
-	log.Debugf("%q returned %v %q", mergeCmd, err, mergeOut)
+	// merge per key path, leave conflicting keys for merge-file
+	paths := [mergeSides]string{current, ancestor, other}
+	clean, err := a.mergeKeys(path, baseOpts, paths)
 	if err != nil {
-		return fmt.Errorf("%s: merge-file failed: %v %q", path, errors.Cause(err), mergeOut)
+		return err
+	}
+
+	// perform 3-way merge
+	if !clean {
+		diffOpt := "--no-diff3"
+		if mergeStyle, _ := a.configGet("", "merge.conflictstyle"); mergeStyle == "diff3" {
+			diffOpt = "--diff3"
+		}
+		mergeCmd := []string{"git", "merge-file", "-L", "CURRENT", "-L", "ANCESTOR", "-L", "OTHER",
+			diffOpt, current, ancestor, other}
+		mergeOut, err := execArgs(mergeCmd, true, nil)
+		log.Debugf("%q returned %v %q", mergeCmd, err, mergeOut)
+		if n := mergeConflicts(err); n > 0 {
+			// git stores the driver result as a blob and checks it out
+			// through smudge filter, so markers are kept encrypted
+			if err := a.encryptConflict(path, baseOpts, current, encryptedCurrent); err != nil {
+				return err
+			}
+			log.Warnf("%s: %d conflict(s), resolve and add the file to encrypt it", path, n)
+			return errExitConflict
+		}
+		if err != nil {
+			return fmt.Errorf("%s: merge-file failed: %v %q", path, errors.Cause(err), mergeOut)
+		}
 	}
 	if !encrypted {
 		return nil
@@ -84,7 +115,10 @@ func (a *action) mergeDriver(path, ancestor, current, other string) error {
 	if err != nil || len(input) == 0 {
 		return nil
 	}
-	opts := baseOpts.forPath(path)
+	opts, err := baseOpts.forPath(path)
+	if err != nil {
+		return err
+	}
 	opts.inputData = input
 
 	// pull source metadata
@@ -110,3 +144,178 @@ func (a *action) mergeDriver(path, ancestor, current, other string) error {
 	}
 	return nil
 }
+
+// conflictKey is the only key of documents carrying merge results
+// with conflict markers
+const conflictKey = "git_sops_conflict"
+
+// conflictStore returns the store of conflict documents, JSON is used
+// whatever the file format is
+func conflictStore() sops.Store {
+	return common.StoreForFormat(formats.Json)
+}
+
+// isConflictData tells whether the data is a conflict document
+func isConflictData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("{\n\t\""+conflictKey+"\": "))
+}
+
+// encryptConflict replaces merge result with conflict markers by
+// a conflict document encrypted with data key of the current side,
+// smudge filter decrypts it back to the markers in the worktree
+func (a *action) encryptConflict(path string, baseOpts *options, current string, encryptedCurrent []byte) error {
+	if encryptedCurrent == nil {
+		return nil // current side is plain, nothing to hide
+	}
+	markers, err := ioutil.ReadFile(current)
+	if err != nil {
+		return errors.Wrapf(err, "reading merge result from %s", current)
+	}
+	opts, err := baseOpts.forPath(path)
+	if err != nil {
+		return err
+	}
+	meta, err := extractMetadata(path, encryptedCurrent, opts)
+	if err != nil {
+		return errors.Wrapf(err, "reading metadata of current side")
+	}
+	tree := sops.Tree{
+		Branches: sops.TreeBranches{{{Key: conflictKey, Value: string(markers)}}},
+		Metadata: sops.Metadata{
+			KeyGroups:       meta.KeyGroups,
+			ShamirThreshold: meta.ShamirThreshold,
+			Version:         version.Version,
+		},
+		FilePath: path,
+	}
+	err = common.EncryptTree(common.EncryptTreeOpts{
+		Tree:    &tree,
+		Cipher:  opts.cipher,
+		DataKey: meta.DataKey,
+	})
+	if err != nil {
+		return err
+	}
+	output, err := conflictStore().EmitEncryptedFile(tree)
+	if err != nil {
+		return errors.Wrapf(err, "encrypting conflict markers")
+	}
+	if err := overwriteFile(current, output, true); err != nil {
+		return errors.Wrapf(err, "writing encrypted merge result to %s", current)
+	}
+	return nil
+}
+
+// decryptConflict returns merge result with conflict markers
+// from a conflict document
+func (a *action) decryptConflict(opts *options) ([]byte, error) {
+	tree, err := conflictStore().LoadEncryptedFile(opts.inputData)
+	if err != nil {
+		return nil, err
+	}
+	_, err = a.decryptTree(common.DecryptTreeOpts{
+		Cipher:      opts.cipher,
+		IgnoreMac:   opts.ignoreMac,
+		Tree:        &tree,
+		KeyServices: opts.keyServices,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(tree.Branches) == 1 && len(tree.Branches[0]) == 1 {
+		if markers, ok := tree.Branches[0][0].Value.(string); ok {
+			return []byte(markers), nil
+		}
+	}
+	return nil, fmt.Errorf("%s: malformed conflict document", opts.inputPath)
+}
+
+// mergeConflicts returns number of conflicts reported by merge-file
+// exit status, or zero if it has succeeded or failed otherwise
+func mergeConflicts(err error) int {
+	exitErr, ok := errors.Cause(err).(*exec.ExitError)
+	if !ok {
+		return 0
+	}
+	if code := exitErr.ExitCode(); code > 0 && code < 128 {
+		return code
+	}
+	return 0
+}
+
+// mergeKeys tries to merge decrypted sides per key path. The result goes
+// to the current file if there are no conflicts. Otherwise all sides are
+// replaced by texts differing only at conflicting keys, or left as is if
+// the format has no tree, and line-based merge should follow.
+func (a *action) mergeKeys(path string, baseOpts *options, paths [mergeSides]string) (clean bool, err error) {
+	var texts [mergeSides][]byte
+	for side, sidePath := range paths {
+		if texts[side], err = ioutil.ReadFile(sidePath); err != nil {
+			return false, errors.Wrapf(err, "reading merged input from %s", sidePath)
+		}
+	}
+	opts, err := baseOpts.forPath(path)
+	if err != nil {
+		return false, err
+	}
+	results, conflicts, err := a.treeMerge(opts, texts)
+	if errors.Is(err, errNoTreeMerge) {
+		log.Debugf("%s: %v, merging lines", path, err)
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "merging %s", path)
+	}
+	if len(conflicts) == 0 {
+		log.Debugf("%s: merged per key", path)
+		err = overwriteFile(paths[mergeCurrent], results[mergeCurrent], true)
+		return true, errors.Wrapf(err, "writing merge result")
+	}
+	log.Debugf("%s: conflicting keys %v", path, conflicts)
+	for side, sidePath := range paths {
+		if err = overwriteFile(sidePath, results[side], true); err != nil {
+			return false, errors.Wrapf(err, "writing merge input to %s", sidePath)
+		}
+	}
+	return false, nil
+}
+
+// resolveConflict takes our or their side of unmerged secret files.
+// The side's blob is staged as is, so its ciphertexts and data key stay
+// intact, and git checkout decrypts it into the worktree.
+func (a *action) resolveConflict(paths []string, theirs bool) error {
+	stage, side := index.OurMode, "--ours"
+	if theirs {
+		stage, side = index.TheirMode, "--theirs"
+	}
+	idx, err := a.s.Index()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		repoPath, err := a.toRepoPath(path)
+		if err != nil {
+			return err
+		}
+		if indexEntry(idx, repoPath, index.AncestorMode, index.OurMode, index.TheirMode) == nil {
+			return fmt.Errorf("%s: not in conflict", path)
+		}
+		var cmds [][]string
+		if entry := indexEntry(idx, repoPath, stage); entry != nil {
+			cacheInfo := fmt.Sprintf("%o,%s,%s", uint32(entry.Mode), entry.Hash, path)
+			cmds = append(cmds,
+				[]string{"git", "checkout", side, "--", path},
+				[]string{"git", "update-index", "--cacheinfo", cacheInfo})
+		} else {
+			// the side has deleted the file
+			cmds = append(cmds, []string{"git", "rm", "-q", "--", path})
+		}
+		for _, cmd := range cmds {
+			if _, err := execArgs(cmd, true, nil); err != nil {
+				return errors.Wrapf(err, "resolve %s", path)
+			}
+		}
+		log.Infof("%s: resolved using %s version", path, side[2:])
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// TestMain runs the test binary as git-sops when it's called back
+// by git filters and drivers configured in test repositories
+func TestMain(m *testing.M) {
+	if os.Getenv("GIT_SOPS_TEST_MAIN") != "" {
+		app := cli.NewApp()
+		app.Commands = Commands()
+		if err := app.Run(os.Args); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// testRepo runs git and git-sops commands in a repository created
+// in a temporary directory, the repository is set up by the test binary
+type testRepo struct {
+	t       *testing.T
+	dir     string
+	env     []string
+	program string
+}
+
+func newTestRepo(t *testing.T) (*testRepo, func()) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	program, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "git-sops-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "keys.txt")
+	keys := fmt.Sprintf("# public key: %s\n%s\n", identity.Recipient(), identity)
+	if err := ioutil.WriteFile(keyFile, []byte(keys), permSecret); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	r := &testRepo{t: t, dir: filepath.Join(dir, "repo"), program: program}
+	r.env = append(os.Environ(),
+		"GIT_SOPS_TEST_MAIN=1",
+		"HOME="+dir,
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"SOPS_AGE_KEY_FILE="+keyFile,
+		"SOPS_AGE="+identity.Recipient().String())
+	if err := os.Mkdir(r.dir, 0700); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return r, cleanup
+}
+
+// run executes the command, the test fails if its exit code differs
+func (r *testRepo) run(exitCode int, name string, args ...string) string {
+	r.t.Helper()
+	if name == "git-sops" {
+		name = r.program
+	}
+	cmd := exec.Command(name, args...)
+	cmd.Dir = r.dir
+	cmd.Env = r.env
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		r.t.Fatal(err)
+	}
+	if code != exitCode {
+		r.t.Fatalf("%s %s: exit code %d, want %d\n%s",
+			filepath.Base(name), strings.Join(args, " "), code, exitCode, out.String())
+	}
+	return out.String()
+}
+
+func (r *testRepo) write(path, data string) {
+	r.t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(r.dir, path), []byte(data), 0600); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *testRepo) read(path string) string {
+	r.t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join(r.dir, path))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestMergeConflict(t *testing.T) {
+	// recursive strategy checks out conflicted driver result even
+	// if it equals our side, ort leaves the worktree file then
+	for _, strategy := range []string{"ort", "recursive"} {
+		t.Run(strategy, func(t *testing.T) {
+			testMergeConflict(t, strategy)
+		})
+	}
+}
+
+func testMergeConflict(t *testing.T, strategy string) {
+	r, cleanup := newTestRepo(t)
+	defer cleanup()
+	r.run(0, "git", "init", "-q", "-b", "master")
+	r.write(".gitattributes", "*.yaml filter=sops diff=sops merge=sops\n")
+	r.write("s.yaml", "a: base-secret\nb: kept-secret\n")
+	r.run(0, "git", "add", "-A")
+	r.run(0, "git", "commit", "-qm", "base")
+	r.run(0, "git-sops", "setup")
+	r.run(0, "git-sops", "encrypt")
+
+	r.run(0, "git", "checkout", "-qb", "other")
+	r.run(0, "git-sops", "set-encrypted")
+	r.write("s.yaml", "a: other-secret\nb: kept-secret\n")
+	r.run(0, "git", "commit", "-qam", "other")
+	r.run(0, "git", "checkout", "-q", "master")
+	r.write("s.yaml", "a: current-secret\nb: kept-secret\n")
+	r.run(0, "git", "commit", "-qam", "current")
+
+	r.run(1, "git", "merge", "-s", strategy, "other")
+	want := "<<<<<<< CURRENT\na: current-secret\n=======\na: other-secret\n>>>>>>> OTHER\nb: kept-secret\n"
+	if got := r.read("s.yaml"); got != want {
+		t.Errorf("worktree file:\n%s\nwant:\n%s", got, want)
+	}
+	if stages := r.run(0, "git", "ls-files", "-u", "s.yaml"); strings.Count(stages, "\n") != 3 {
+		t.Errorf("unmerged stages:\n%s", stages)
+	}
+	// base commit is plain before encrypt rewrites it
+	objects := r.run(0, "git", "cat-file", "--batch-all-objects", "--batch")
+	for _, secret := range []string{"current-secret", "other-secret", "<<<<<<<"} {
+		if strings.Contains(objects, secret) {
+			t.Errorf("git objects contain %q", secret)
+		}
+	}
+
+	r.run(128, "git", "add", "s.yaml")
+	r.write("s.yaml", "a: merged-secret\nb: kept-secret\n")
+	r.run(0, "git", "add", "s.yaml")
+	r.run(0, "git", "commit", "-q", "--no-edit")
+	if blob := r.run(0, "git", "show", "HEAD:s.yaml"); strings.Contains(blob, "merged-secret") {
+		t.Errorf("merge result is not encrypted:\n%s", blob)
+	}
+	if status := r.run(0, "git", "status", "--porcelain"); status != "" {
+		t.Errorf("worktree is not clean:\n%s", status)
+	}
+}
@@ -2,17 +2,27 @@ package git
 
 import (
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.mozilla.org/sops/v3"
 	"go.mozilla.org/sops/v3/aes"
 	"go.mozilla.org/sops/v3/age"
+	"go.mozilla.org/sops/v3/azkv"
 	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/config"
+	"go.mozilla.org/sops/v3/gcpkms"
+	"go.mozilla.org/sops/v3/hcvault"
 	"go.mozilla.org/sops/v3/keys"
 	"go.mozilla.org/sops/v3/keyservice"
+	"go.mozilla.org/sops/v3/kms"
 	"go.mozilla.org/sops/v3/mangle"
+	"go.mozilla.org/sops/v3/pgp"
 	"go.mozilla.org/sops/v3/version"
+
+	"github.com/pkg/errors"
 )
 
 type options struct {
@@ -24,11 +34,22 @@ type options struct {
 	inputStore     sops.Store
 	outputStore    sops.Store
 	keyServices    []keyservice.KeyServiceClient
+	keyServiceURIs []string // remote key services saved by setup
 	keyGroups      []sops.KeyGroup
 	groupThreshold int
-	ageRecipients  string
 	indent         int
 	fileModtime    bool
+	// master keys, groups are separated by vertical bar
+	kmsArns         string
+	gcpKmsIDs       string
+	azureKvURLs     string
+	pgpFingerprints string
+	hcVaultURIs     string
+	ageRecipients   string
+	// creation rules
+	configPath    string
+	creationRules *config.CreationRules // parsed once per process
+	ruleKeys      bool                  // key groups come from creation rule
 	// encrypt-only options
 	meta sops.Metadata
 	// key filters (encrypt-only)
@@ -37,7 +58,9 @@ type options struct {
 	unencryptedRegex  string
 	encryptedRegex    string
 	// decrypt-only options
-	ignoreMac bool
+	ignoreMac   bool
+	noKey       bool // leave files which can't be decrypted encrypted
+	trackLocked bool // record such files as locked in worktree
 	// mangling options
 	renameKeys replace
 	mangling   *mangle.Options
@@ -50,15 +73,24 @@ const optUseGit = true
 
 var zeroTime time.Time
 
-func (o *options) forPath(path string) *options {
+func (o *options) forPath(path string) (*options, error) {
 	copy := *o
 	o = &copy
 	o.inputPath = path
+	o.cipher = aes.NewCipher() // per-file IV stash
 	o.inputStore = nil
 	o.outputStore = nil
 	o.meta.LastModified = zeroTime
+	// generating data key stores it into master keys, so that files
+	// encrypted in parallel must not share them
+	o.meta.KeyGroups = copyKeyGroups(o.meta.KeyGroups)
 	if path == "" {
-		return o
+		return o, nil
+	}
+	if o.creationRules != nil {
+		if err := o.applyCreationRule(path); err != nil {
+			return nil, err
+		}
 	}
 
 	getStore := func(typeParam string) sops.Store {
@@ -72,15 +104,70 @@ func (o *options) forPath(path string) *options {
 	o.outputStore = getStore("output-type")
 
 	if !o.fileModtime {
-		return o
+		return o, nil
 	}
 	fi, err := os.Stat(path)
 	if err != nil {
 		o.meta.LastModified = zeroTime
-		return o
+		return o, nil
 	}
 	o.meta.LastModified = fi.ModTime().UTC()
-	return o
+	return o, nil
+}
+
+// applyCreationRule lets a matching .sops.yaml creation rule
+// override repository-wide keys and key filters
+func (o *options) applyCreationRule(path string) error {
+	rule, err := o.creationRules.ForFile(o.a.toAbsPath(path), nil)
+	if err == config.ErrNoMatchingCreationRule {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "load creation rule for %s", path)
+	}
+	if rule == nil {
+		return nil
+	}
+	if validateKeyGroups(rule.KeyGroups) == nil {
+		o.keyGroups = rule.KeyGroups
+		o.meta.KeyGroups = rule.KeyGroups
+		o.ruleKeys = true
+	}
+	if rule.ShamirThreshold > 0 {
+		o.groupThreshold = rule.ShamirThreshold
+		o.meta.ShamirThreshold = rule.ShamirThreshold
+	}
+	// key filters are mutually exclusive, replace them all together
+	if rule.UnencryptedSuffix != "" || rule.EncryptedSuffix != "" ||
+		rule.UnencryptedRegex != "" || rule.EncryptedRegex != "" {
+		o.unencryptedSuffix = rule.UnencryptedSuffix
+		o.encryptedSuffix = rule.EncryptedSuffix
+		o.unencryptedRegex = rule.UnencryptedRegex
+		o.encryptedRegex = rule.EncryptedRegex
+		o.meta.UnencryptedSuffix = rule.UnencryptedSuffix
+		o.meta.EncryptedSuffix = rule.EncryptedSuffix
+		o.meta.UnencryptedRegex = rule.UnencryptedRegex
+		o.meta.EncryptedRegex = rule.EncryptedRegex
+	}
+	log.Debugf("%s: applied creation rule from %s", path, o.configPath)
+	return nil
+}
+
+// getConfigPath locates optional .sops.yaml with creation rules, only
+// the top of worktree is searched so that rules of parent directories
+// or home directory don't apply to the repository
+func (a *action) getConfigPath() (string, error) {
+	path := a.getString("config", optUseGit)
+	if path == "" {
+		if a.w == nil {
+			return "", nil // bare repository has no worktree config
+		}
+		path = filepath.Join(a.d, sopsConfigFileName)
+		if _, err := os.Stat(path); err != nil {
+			return "", nil // config file is not mandatory
+		}
+	}
+	return filepath.Abs(a.toAbsPath(path))
 }
 
 func (a *action) getOptions() (*options, error) {
@@ -104,6 +191,10 @@ func (a *action) getOptions() (*options, error) {
 	if err != nil {
 		return nil, err
 	}
+	noKey, err := a.getBool("no-key", optUseGit)
+	if err != nil {
+		return nil, err
+	}
 
 	commentPrefix := a.getString("encrypted-comment-prefix", optUseGit)
 	commentSuffix := a.getString("encrypted-comment-suffix", optUseGit)
@@ -118,6 +209,18 @@ func (a *action) getOptions() (*options, error) {
 		return nil, err
 	}
 
+	configPath, err := a.getConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	var creationRules *config.CreationRules
+	if configPath != "" {
+		creationRules, err = config.LoadCreationRules(configPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load creation rules from %s", configPath)
+		}
+	}
+
 	o := &options{
 		a: a,
 		// key filters
@@ -128,17 +231,27 @@ func (a *action) getOptions() (*options, error) {
 		// parameters
 		cipher:         aes.NewCipher(),
 		keyServices:    a.getKeyServices(),
+		keyServiceURIs: a.getKeyServiceURIs(),
 		keyGroups:      groups,
 		groupThreshold: threshold,
-		ageRecipients:  a.getString("age", optUseGit),
 		indent:         indent,
 		ignoreMac:      ignoreMac,
+		noKey:          noKey,
 		fileModtime:    fileModtime,
+		configPath:     configPath,
+		creationRules:  creationRules,
 		// mangling
 		mangling:               mangleOpts,
 		renameKeys:             renameKeys,
 		encryptedCommentPrefix: commentPrefix,
 		encryptedCommentSuffix: commentSuffix,
+		// master keys
+		kmsArns:         a.getString(optKMS, optUseGit),
+		gcpKmsIDs:       a.getString(optGcpKMS, optUseGit),
+		azureKvURLs:     a.getString(optAzureKV, optUseGit),
+		pgpFingerprints: a.getString(optPGP, optUseGit),
+		hcVaultURIs:     a.getString(optHcVault, optUseGit),
+		ageRecipients:   a.getString(optAge, optUseGit),
 	}
 	o.meta = sops.Metadata{
 		KeyGroups:         o.keyGroups,
@@ -154,8 +267,26 @@ func (a *action) getOptions() (*options, error) {
 
 func (o *options) save() (err error) {
 	a := o.a
-	if err = a.setString("age", o.ageRecipients); err != nil {
-		return err
+	if err = a.setString(optKMS, o.kmsArns); err != nil {
+		return
+	}
+	if err = a.setString(optGcpKMS, o.gcpKmsIDs); err != nil {
+		return
+	}
+	if err = a.setString(optAzureKV, o.azureKvURLs); err != nil {
+		return
+	}
+	if err = a.setString(optPGP, o.pgpFingerprints); err != nil {
+		return
+	}
+	if err = a.setString(optHcVault, o.hcVaultURIs); err != nil {
+		return
+	}
+	if err = a.setString(optAge, o.ageRecipients); err != nil {
+		return
+	}
+	if err = a.setString("keyservice", strings.Join(o.keyServiceURIs, ",")); err != nil {
+		return
 	}
 	if err = a.setInt(optThreshold, o.groupThreshold); err != nil {
 		return
@@ -166,6 +297,9 @@ func (o *options) save() (err error) {
 	if err = a.setBool("file-modtime", o.fileModtime); err != nil {
 		return
 	}
+	if err = a.setBool("no-key", o.noKey); err != nil {
+		return
+	}
 	if err = a.setInt("indent", o.indent); err != nil {
 		return
 	}
@@ -196,7 +330,28 @@ func (o *options) save() (err error) {
 	return nil
 }
 
+// getKeyServiceURIs returns remote key services given by user
+// or saved in git config
+func (a *action) getKeyServiceURIs() []string {
+	uris := a.c.StringSlice("keyservice")
+	if len(uris) == 0 {
+		value, _ := a.configGet("", "sops.keyservice")
+		uris = splitList(value)
+	}
+	return uris
+}
+
+// getKeyServices returns remote key services, e.g. caching agent,
+// followed by the local one, so that remote services are asked first
 func (a *action) getKeyServices() (svcs []keyservice.KeyServiceClient) {
+	for _, uri := range a.getKeyServiceURIs() {
+		svc, err := dialKeyService(uri)
+		if err != nil {
+			log.Warnf("skipping key service %s: %v", uri, err)
+			continue
+		}
+		svcs = append(svcs, svc)
+	}
 	useLocal := a.c.Bool("enable-local-keyservice")
 	if useLocal {
 		svcs = append(svcs, keyservice.NewLocalClient())
@@ -204,22 +359,126 @@ func (a *action) getKeyServices() (svcs []keyservice.KeyServiceClient) {
 	return
 }
 
-func (a *action) getKeyGroups(useGit bool) ([]sops.KeyGroup, error) {
-	var ageMasterKeys []keys.MasterKey
-	ageRecipients := a.getString("age", useGit)
-	if ageRecipients != "" {
-		ageKeys, err := age.MasterKeysFromRecipients(ageRecipients)
-		if err != nil {
-			return nil, err
+// groupSeparator separates key groups in master key options
+const groupSeparator = "|"
+
+// master key options in the order of key group members
+var masterKeyOpts = []struct {
+	name  string
+	parse func(value string) ([]keys.MasterKey, error)
+}{
+	{optKMS, func(value string) (list []keys.MasterKey, err error) {
+		for _, k := range kms.MasterKeysFromArnString(value, nil, "") {
+			list = append(list, k)
+		}
+		return
+	}},
+	{optGcpKMS, func(value string) (list []keys.MasterKey, err error) {
+		for _, k := range gcpkms.MasterKeysFromResourceIDString(value) {
+			list = append(list, k)
+		}
+		return
+	}},
+	{optAzureKV, func(value string) (list []keys.MasterKey, err error) {
+		azkvKeys, err := azkv.MasterKeysFromURLs(value)
+		for _, k := range azkvKeys {
+			list = append(list, k)
+		}
+		return
+	}},
+	{optPGP, func(value string) (list []keys.MasterKey, err error) {
+		for _, k := range pgp.MasterKeysFromFingerprintString(value) {
+			list = append(list, k)
+		}
+		return
+	}},
+	{optHcVault, func(value string) (list []keys.MasterKey, err error) {
+		vaultKeys, err := hcvault.NewMasterKeysFromURIs(value)
+		for _, k := range vaultKeys {
+			list = append(list, k)
 		}
+		return
+	}},
+	{optAge, func(value string) (list []keys.MasterKey, err error) {
+		ageKeys, err := age.MasterKeysFromRecipients(value)
 		for _, k := range ageKeys {
-			ageMasterKeys = append(ageMasterKeys, k)
+			list = append(list, k)
+		}
+		return
+	}},
+}
+
+// getKeyGroups combines master key options into key groups.
+// Every option is a list of groups separated by vertical bar, where group
+// is a comma separated list of keys, e.g. "age1a,age1b|age1c".
+// Groups with the same index in different options are merged.
+func (a *action) getKeyGroups(useGit bool) ([]sops.KeyGroup, error) {
+	var groups []sops.KeyGroup
+	for _, opt := range masterKeyOpts {
+		value := a.getString(opt.name, useGit)
+		if value == "" {
+			continue
+		}
+		for i, part := range strings.Split(value, groupSeparator) {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			masterKeys, err := opt.parse(part)
+			if err != nil {
+				return nil, errors.Wrapf(err, "parse %s keys", opt.name)
+			}
+			for len(groups) <= i {
+				groups = append(groups, nil)
+			}
+			groups[i] = append(groups[i], masterKeys...)
+		}
+	}
+	var nonEmpty []sops.KeyGroup
+	for _, group := range groups {
+		if len(group) > 0 {
+			nonEmpty = append(nonEmpty, group)
+		}
+	}
+	if len(nonEmpty) == 0 {
+		nonEmpty = []sops.KeyGroup{{}}
+	}
+	log.Debugf("master keys: %+v", nonEmpty)
+	return nonEmpty, nil
+}
+
+// copyKeyGroups duplicates master keys with their encrypted data keys
+func copyKeyGroups(groups []sops.KeyGroup) []sops.KeyGroup {
+	if groups == nil {
+		return nil
+	}
+	copied := make([]sops.KeyGroup, len(groups))
+	for i, group := range groups {
+		copied[i] = make(sops.KeyGroup, len(group))
+		for j, key := range group {
+			switch k := key.(type) {
+			case *kms.MasterKey:
+				dup := *k
+				key = &dup
+			case *gcpkms.MasterKey:
+				dup := *k
+				key = &dup
+			case *azkv.MasterKey:
+				dup := *k
+				key = &dup
+			case *pgp.MasterKey:
+				dup := *k
+				key = &dup
+			case *hcvault.MasterKey:
+				dup := *k
+				key = &dup
+			case *age.MasterKey:
+				dup := *k
+				key = &dup
+			}
+			copied[i][j] = key
 		}
 	}
-	var group sops.KeyGroup
-	group = append(group, ageMasterKeys...)
-	log.Debugf("master keys: %+v", group)
-	return []sops.KeyGroup{group}, nil
+	return copied
 }
 
 func (a *action) getString(name string, useGit bool) string {
@@ -0,0 +1,275 @@
+package git
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"runtime"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+
+	"github.com/pkg/errors"
+)
+
+// filterProcess serves git's long-running filter protocol version 2,
+// see gitattributes(5). The action, options and data keys live in memory
+// for the whole git operation. Smudging may be delayed, then decryption
+// runs in background while git asks for available blobs.
+type filterProcess struct {
+	a       *action
+	in      *pktline.Scanner
+	out     *pktline.Encoder
+	w       *bufio.Writer
+	caps    map[string]bool
+	delayed map[string]*smudgeJob // delayed blobs by path
+	ready   chan *smudgeJob
+	slots   chan struct{}
+	pending int // delayed blobs not listed yet
+}
+
+type smudgeJob struct {
+	path   string
+	opts   *options
+	output []byte
+	err    error
+}
+
+var errFilterProtocol = errors.New("filter protocol error")
+
+var filterCapabilities = []string{"clean", "smudge", "delay"}
+
+func (a *action) filterProcess(r io.Reader, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	p := &filterProcess{
+		a:       a,
+		in:      pktline.NewScanner(r),
+		out:     pktline.NewEncoder(bw),
+		w:       bw,
+		caps:    map[string]bool{},
+		delayed: map[string]*smudgeJob{},
+		ready:   make(chan *smudgeJob, 64),
+		slots:   make(chan struct{}, runtime.NumCPU()),
+	}
+	if err := p.handshake(); err != nil {
+		return err
+	}
+	for {
+		header, err := p.readKeys()
+		if err == io.EOF {
+			return nil // git has closed the pipe
+		}
+		if err != nil {
+			return err
+		}
+		if err = p.serve(header); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *filterProcess) handshake() error {
+	welcome, err := p.readList()
+	if err != nil {
+		return err
+	}
+	if len(welcome) < 2 || welcome[0] != "git-filter-client" {
+		return errors.Wrap(errFilterProtocol, "invalid welcome")
+	}
+	supported := false
+	for _, line := range welcome[1:] {
+		supported = supported || line == "version=2"
+	}
+	if !supported {
+		return errors.Wrap(errFilterProtocol, "unsupported version")
+	}
+	if err := p.writeList("git-filter-server", "version=2"); err != nil {
+		return err
+	}
+
+	caps, err := p.readList()
+	if err != nil {
+		return err
+	}
+	var reply []string
+	for _, line := range caps {
+		name := strings.TrimPrefix(line, "capability=")
+		for _, known := range filterCapabilities {
+			if name == known {
+				p.caps[name] = true
+				reply = append(reply, line)
+			}
+		}
+	}
+	log.Debugf("filter process capabilities: %v", reply)
+	return p.writeList(reply...)
+}
+
+// serve handles one command of git
+func (p *filterProcess) serve(header map[string]string) error {
+	command, path := header["command"], header["pathname"]
+	if command == "list_available_blobs" {
+		return p.listAvailable()
+	}
+	if command != "clean" && command != "smudge" || !p.caps[command] {
+		return errors.Wrapf(errFilterProtocol, "unknown command %q", command)
+	}
+	input, err := p.readContent()
+	if err != nil {
+		return err
+	}
+
+	var output []byte
+	switch {
+	case command == "clean":
+		output, err = p.a.cleanData(path, input, true, "index", "")
+	case p.delayed[path] != nil:
+		// git asks for a delayed blob, the content is empty
+		job := p.delayed[path]
+		delete(p.delayed, path)
+		output, err = job.output, job.err
+	default:
+		var opts *options
+		opts, err = p.a.prepareSmudge(path, input, true, false)
+		output = input
+		if err == nil && opts != nil {
+			if header["can-delay"] == "1" && p.caps["delay"] {
+				p.delay(path, opts)
+				return p.writeList("status=delayed")
+			}
+			output, err = p.a.smudgeData(opts)
+		}
+	}
+	if err != nil {
+		log.Errorf("%s %s: %v", command, path, err)
+		return p.writeList("status=error")
+	}
+	return p.writeContent(output)
+}
+
+// delay starts decryption in background
+func (p *filterProcess) delay(path string, opts *options) {
+	job := &smudgeJob{path: path, opts: opts}
+	p.delayed[path] = job
+	p.pending++
+	go func() {
+		p.slots <- struct{}{}
+		job.output, job.err = p.a.smudgeData(job.opts)
+		<-p.slots
+		p.ready <- job
+	}()
+}
+
+// listAvailable blocks until at least one delayed blob is decrypted
+// and lists all blobs which are ready by now
+func (p *filterProcess) listAvailable() error {
+	var paths []string
+	add := func(job *smudgeJob) {
+		p.pending--
+		paths = append(paths, "pathname="+job.path)
+	}
+	if p.pending > 0 {
+		add(<-p.ready)
+	}
+	for more := true; more; {
+		select {
+		case job := <-p.ready:
+			add(job)
+		default:
+			more = false
+		}
+	}
+	if err := p.writeList(paths...); err != nil {
+		return err
+	}
+	return p.writeList("status=success")
+}
+
+// readKeys reads key=value list, returns io.EOF if git has finished
+func (p *filterProcess) readKeys() (map[string]string, error) {
+	lines, err := p.readList()
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]string{}
+	for _, line := range lines {
+		if eq := strings.IndexByte(line, '='); eq > 0 {
+			keys[line[:eq]] = line[eq+1:]
+		}
+	}
+	return keys, nil
+}
+
+// readList reads text packets up to flush packet
+func (p *filterProcess) readList() ([]string, error) {
+	var lines []string
+	for first := true; ; first = false {
+		if !p.in.Scan() {
+			if err := p.in.Err(); err != nil {
+				return nil, err
+			}
+			if first {
+				return nil, io.EOF
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+		line := p.in.Bytes()
+		if len(line) == 0 {
+			return lines, nil
+		}
+		lines = append(lines, strings.TrimSuffix(string(line), "\n"))
+	}
+}
+
+// readContent reads binary packets up to flush packet
+func (p *filterProcess) readContent() ([]byte, error) {
+	var buf bytes.Buffer
+	for p.in.Scan() {
+		data := p.in.Bytes()
+		if len(data) == 0 {
+			return buf.Bytes(), nil
+		}
+		buf.Write(data)
+	}
+	if err := p.in.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.ErrUnexpectedEOF
+}
+
+// writeList sends text packets terminated by flush packet
+func (p *filterProcess) writeList(lines ...string) error {
+	for _, line := range lines {
+		if err := p.out.EncodeString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	if err := p.out.Flush(); err != nil {
+		return err
+	}
+	return p.w.Flush()
+}
+
+// writeContent sends successful status, data and unchanged final status
+func (p *filterProcess) writeContent(data []byte) error {
+	if err := p.out.EncodeString("status=success\n"); err != nil {
+		return err
+	}
+	if err := p.out.Flush(); err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > pktline.MaxPayloadSize {
+			n = pktline.MaxPayloadSize
+		}
+		if err := p.out.Encode(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	if err := p.out.Flush(); err != nil {
+		return err
+	}
+	return p.writeList() // keep status
+}
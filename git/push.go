@@ -0,0 +1,233 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"go.mozilla.org/sops/v3"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errPlaintextPush = errors.New("refusing to push unencrypted secret files")
+	errNotEncrypted  = errors.New("not encrypted")
+	errNoRecipients  = errors.New("no master keys in sops metadata")
+	errNoMAC         = errors.New("no MAC in sops metadata")
+)
+
+// refUpdate is a line of pre-push or pre-receive hook input,
+// the remote side is the old value of pre-receive update
+type refUpdate struct {
+	localRef, remoteRef   string
+	localHash, remoteHash plumbing.Hash
+}
+
+// secretProblem is a secret file failing the check
+type secretProblem struct {
+	commit plumbing.Hash
+	blob   plumbing.Hash
+	path   string
+	err    error
+}
+
+func (p secretProblem) String() string {
+	return fmt.Sprintf("%s %s: %v", shortHash(p.commit), p.path, p.err)
+}
+
+// secretChecker verifies that secret files of commits carry valid sops
+// metadata. Checking needs no keys unless files are decrypted too,
+// blobs shared by commits are checked once per path, as store format
+// and creation rules depend on it.
+type secretChecker struct {
+	a       *action
+	opts    *options
+	allowed map[string]bool // allowed recipients, any if empty
+	decrypt bool            // decrypt and verify MAC
+	checked map[transKey]error
+}
+
+func (a *action) newSecretChecker() (*secretChecker, error) {
+	opts, err := a.getOptions()
+	if err != nil {
+		return nil, err
+	}
+	return &secretChecker{a: a, opts: opts, checked: map[transKey]error{}}, nil
+}
+
+// checkCommit checks all secret files of the commit
+func (c *secretChecker) checkCommit(hash plumbing.Hash) ([]secretProblem, error) {
+	files, err := c.a.matchFiles(hash.String())
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	commit, err := c.a.r.CommitObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	var problems []secretProblem
+	for _, path := range files {
+		file, err := tree.File(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%s", shortHash(hash), path)
+		}
+		key := transKey{path: path, hash: file.Hash}
+		err, ok := c.checked[key]
+		if !ok {
+			err = c.checkBlob(path, file)
+			c.checked[key] = err
+		}
+		if err != nil {
+			problems = append(problems, secretProblem{commit: hash, blob: file.Hash, path: path, err: err})
+		}
+	}
+	return problems, nil
+}
+
+// checkBlob parses file metadata, empty files are fine
+func (c *secretChecker) checkBlob(path string, file *object.File) error {
+	data, err := file.Contents()
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	opts, err := c.opts.forPath(path)
+	if err != nil {
+		return err
+	}
+	input := opts.mangling.Mangle([]byte(data), path, false)
+	tree, err := loadEncryptedFileData(opts.inputStore, path, input)
+	if isMetaNotFound(err) {
+		return errNotEncrypted
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkMetadata(&tree.Metadata); err != nil {
+		return err
+	}
+	if err := checkRecipients(&tree.Metadata, c.allowed); err != nil {
+		return err
+	}
+	if c.decrypt {
+		opts.inputData = []byte(data)
+		opts.ignoreMac = false
+		_, err = c.a.sopsDecrypt(opts)
+	}
+	return err
+}
+
+// checkMetadata rejects metadata which can't protect the file
+func checkMetadata(meta *sops.Metadata) error {
+	keys := 0
+	for _, group := range meta.KeyGroups {
+		keys += len(group)
+	}
+	if keys == 0 {
+		return errNoRecipients
+	}
+	if meta.MessageAuthenticationCode == "" {
+		return errNoMAC
+	}
+	return nil
+}
+
+// readRefUpdates parses hook input lines, either pre-push lines
+//
+//	<local ref> <local hash> <remote ref> <remote hash>
+//
+// or pre-receive lines
+//
+//	<old hash> <new hash> <ref>
+func readRefUpdates(r io.Reader) ([]refUpdate, error) {
+	var updates []refUpdate
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+		case 3:
+			updates = append(updates, refUpdate{
+				remoteRef:  fields[2],
+				remoteHash: plumbing.NewHash(fields[0]),
+				localHash:  plumbing.NewHash(fields[1]),
+			})
+		case 4:
+			updates = append(updates, refUpdate{
+				localRef:   fields[0],
+				localHash:  plumbing.NewHash(fields[1]),
+				remoteRef:  fields[2],
+				remoteHash: plumbing.NewHash(fields[3]),
+			})
+		default:
+			return nil, fmt.Errorf("invalid ref update %q", scanner.Text())
+		}
+	}
+	return updates, scanner.Err()
+}
+
+// prePush serves pre-push hook: every secret file of commits not yet
+// present on the remote must be encrypted, whatever branch is pushed
+func (a *action) prePush(remote string, in io.Reader) error {
+	updates, err := readRefUpdates(in)
+	if err != nil {
+		return err
+	}
+	checker, err := a.newSecretChecker()
+	if err != nil {
+		return err
+	}
+	var problems []secretProblem
+	seen := map[plumbing.Hash]bool{}
+	for _, u := range updates {
+		if u.localHash == zeroHash {
+			continue // deletion
+		}
+		revList := []string{"git", "rev-list", u.localHash.String(), "--not"}
+		if u.remoteHash != zeroHash && a.hasCommit(u.remoteHash) {
+			revList = append(revList, u.remoteHash.String())
+		}
+		if remote != "" {
+			revList = append(revList, "--remotes="+remote)
+		}
+		out, err := execArgs(revList, false, nil)
+		if err != nil {
+			return errors.Wrapf(err, "list commits of %s", u.localRef)
+		}
+		for _, line := range strings.Fields(out) {
+			hash := plumbing.NewHash(line)
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			found, err := checker.checkCommit(hash)
+			if err != nil {
+				return err
+			}
+			problems = append(problems, found...)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, p := range problems {
+		log.Errorf("%s", p)
+	}
+	return errPlaintextPush
+}
+
+// hasCommit tells whether the commit is present locally
+func (a *action) hasCommit(hash plumbing.Hash) bool {
+	_, err := a.r.CommitObject(hash)
+	return err == nil
+}
@@ -184,7 +184,13 @@ func execCommand(command string, interactive bool, stdout io.Writer) (out string
 	if tokens, err = shlex.Split(command); err != nil {
 		return
 	}
-	prog, args := tokens[0], tokens[1:]
+	return execArgs(tokens, interactive, stdout)
+}
+
+// execArgs runs a command given as argv, so that arguments such as
+// paths and messages are passed verbatim
+func execArgs(argv []string, interactive bool, stdout io.Writer) (out string, err error) {
+	prog, args := argv[0], argv[1:]
 	cmd := exec.Command(prog, args...)
 	if interactive {
 		cmd.Stdin = os.Stdin
@@ -0,0 +1,162 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"go.mozilla.org/sops/v3"
+
+	"github.com/pkg/errors"
+)
+
+var errRejected = errors.New("push rejected: secret files must be encrypted for allowed recipients")
+
+// quarantineStorage finds objects of a push in progress, which git
+// keeps aside until pre-receive and update hooks accept them
+type quarantineStorage struct {
+	*filesystem.Storage
+	incoming *filesystem.Storage
+}
+
+func (s *quarantineStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.incoming.EncodedObject(t, h)
+	if err == plumbing.ErrObjectNotFound {
+		return s.Storage.EncodedObject(t, h)
+	}
+	return obj, err
+}
+
+func (s *quarantineStorage) HasEncodedObject(h plumbing.Hash) error {
+	if err := s.incoming.HasEncodedObject(h); err == nil {
+		return nil
+	}
+	return s.Storage.HasEncodedObject(h)
+}
+
+// openQuarantine makes received objects visible to go-git. The storage
+// expects objects under its root, so the root is a temporary directory
+// linking to the quarantine. Returned function cleans it up.
+func (a *action) openQuarantine() (func(), error) {
+	path := os.Getenv("GIT_QUARANTINE_PATH")
+	if path == "" {
+		return func() {}, nil
+	}
+	root, err := ioutil.TempDir("", "git-sops-")
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() { _ = os.RemoveAll(root) }
+	if err := os.Symlink(path, filepath.Join(root, "objects")); err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "link quarantine")
+	}
+	incoming := filesystem.NewStorage(osfs.New(root), cache.NewObjectLRUDefault())
+	repo, err := git.Open(&quarantineStorage{Storage: a.s, incoming: incoming}, nil)
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrap(err, "open quarantine")
+	}
+	a.r = repo
+	log.Debugf("reading received objects from %s", path)
+	return cleanup, nil
+}
+
+// receiveCheck serves pre-receive hook reading ref updates from stdin,
+// or update hook given the ref update in arguments. Secret files of new
+// commits must carry sops metadata, recipients are checked against the
+// allowlist if any. Neither worktree nor keys are needed.
+func (a *action) receiveCheck(args []string, in io.Reader, allowed []string) error {
+	var updates []refUpdate
+	switch len(args) {
+	case 0:
+		lines, err := readRefUpdates(in)
+		if err != nil {
+			return err
+		}
+		updates = lines
+	case 3:
+		updates = []refUpdate{{
+			remoteRef:  args[0],
+			remoteHash: plumbing.NewHash(args[1]),
+			localHash:  plumbing.NewHash(args[2]),
+		}}
+	default:
+		return errExitExtraArgs
+	}
+
+	cleanup, err := a.openQuarantine()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	checker, err := a.newSecretChecker()
+	if err != nil {
+		return err
+	}
+	if len(allowed) == 0 {
+		value, _ := a.configGet("", "sops.allowed-recipients")
+		allowed = splitList(value)
+	}
+	checker.allowed = map[string]bool{}
+	for _, key := range allowed {
+		checker.allowed[key] = true
+	}
+
+	rejected := false
+	seen := map[plumbing.Hash]bool{}
+	for _, u := range updates {
+		if u.localHash == zeroHash {
+			continue // deletion
+		}
+		// refs are not updated yet, so all of them are old
+		revList := []string{"git", "rev-list", u.localHash.String(), "--not", "--all"}
+		out, err := execArgs(revList, false, nil)
+		if err != nil {
+			return errors.Wrapf(err, "list commits of %s", u.remoteRef)
+		}
+		for _, line := range strings.Fields(out) {
+			hash := plumbing.NewHash(line)
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			problems, err := checker.checkCommit(hash)
+			if err != nil {
+				return err
+			}
+			for _, p := range problems {
+				log.Errorf("%s %s", u.remoteRef, p)
+				rejected = true
+			}
+		}
+	}
+	if rejected {
+		return errRejected
+	}
+	return nil
+}
+
+// checkRecipients rejects master keys missing from the allowlist
+func checkRecipients(meta *sops.Metadata, allowed map[string]bool) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, group := range meta.KeyGroups {
+		for _, key := range group {
+			if !allowed[key.ToString()] {
+				return fmt.Errorf("recipient %s is not allowed", key.ToString())
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package git
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/cmd/sops/common"
+	"go.mozilla.org/sops/v3/keys"
+
+	"github.com/pkg/errors"
+)
+
+var pgpFingerprintRe = regexp.MustCompile(`^[0-9A-Fa-f]{16,40}$`)
+
+// recipientOption finds master key option for the key by its format
+func recipientOption(key string) (string, error) {
+	switch {
+	case strings.HasPrefix(key, "age1"):
+		return optAge, nil
+	case strings.HasPrefix(key, "arn:"):
+		return optKMS, nil
+	case strings.HasPrefix(key, "projects/"):
+		return optGcpKMS, nil
+	case strings.Contains(key, ".vault.azure.net/"):
+		return optAzureKV, nil
+	case strings.HasPrefix(key, "https://") || strings.HasPrefix(key, "http://"):
+		return optHcVault, nil
+	case pgpFingerprintRe.MatchString(key):
+		return optPGP, nil
+	}
+	return "", fmt.Errorf("unknown master key format %q", key)
+}
+
+// parseRecipient makes master key of the option
+func parseRecipient(opt, key string) (keys.MasterKey, error) {
+	for _, o := range masterKeyOpts {
+		if o.name != opt {
+			continue
+		}
+		list, err := o.parse(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) != 1 {
+			return nil, fmt.Errorf("invalid master key %q", key)
+		}
+		return list[0], nil
+	}
+	return nil, fmt.Errorf("unknown master key option %q", opt)
+}
+
+// editKeyOption adds the key to a group of master key option value,
+// e.g. "age1a,age1b|age1c", unless some group has it, or removes it
+// from all groups
+func editKeyOption(value, key string, group int, add bool) string {
+	var groups [][]string
+	found := false
+	for _, part := range strings.Split(value, groupSeparator) {
+		var kept []string
+		for _, k := range strings.Split(part, ",") {
+			if k = strings.TrimSpace(k); k == "" {
+				continue
+			}
+			if k == key {
+				found = true
+				if !add {
+					continue
+				}
+			}
+			kept = append(kept, k)
+		}
+		groups = append(groups, kept)
+	}
+	if add && !found {
+		for len(groups) <= group {
+			groups = append(groups, nil)
+		}
+		groups[group] = append(groups[group], key)
+	}
+	var parts []string
+	for _, kept := range groups {
+		parts = append(parts, strings.Join(kept, ","))
+	}
+	for len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, groupSeparator)
+}
+
+// keyGroupSizes counts keys per group of master key option values,
+// groups with the same index in different options are merged
+func keyGroupSizes(values []string) []int {
+	var sizes []int
+	for _, value := range values {
+		for i, part := range strings.Split(value, groupSeparator) {
+			for len(sizes) <= i {
+				sizes = append(sizes, 0)
+			}
+			sizes[i] += len(splitList(part))
+		}
+	}
+	return sizes
+}
+
+// hasKey tells whether some key group has the master key
+func hasKey(groups []sops.KeyGroup, key string) bool {
+	for _, g := range groups {
+		for _, k := range g {
+			if k.ToString() == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addKey returns copy of key groups with the master key in the group
+func addKey(groups []sops.KeyGroup, key keys.MasterKey, group int) ([]sops.KeyGroup, bool) {
+	for _, g := range groups {
+		for _, k := range g {
+			if k.ToString() == key.ToString() {
+				return groups, false
+			}
+		}
+	}
+	result := append([]sops.KeyGroup{}, groups...)
+	for len(result) <= group {
+		result = append(result, nil)
+	}
+	result[group] = append(append(sops.KeyGroup{}, result[group]...), key)
+	return result, true
+}
+
+// editRecipients adds master key to the configured key group and to key
+// groups of all secret files in the index, or removes it from all groups.
+// Data keys are kept and re-wrapped for the new master keys, updated files
+// are staged.
+func (a *action) editRecipients(key string, add bool, group int, dryRun bool) error {
+	opt, err := recipientOption(key)
+	if err != nil {
+		return err
+	}
+	masterKey, err := parseRecipient(opt, key)
+	if err != nil {
+		return err
+	}
+	key = masterKey.ToString()
+	baseOpts, err := a.getOptions()
+	if err != nil {
+		return err
+	}
+
+	// empty groups would shift numbers of the following ones
+	value, err := a.configGet("", "sops."+opt)
+	if err != nil {
+		return err
+	}
+	newValue := editKeyOption(value, key, group, add)
+	var oldValues, newValues []string
+	for _, o := range masterKeyOpts {
+		other, err := a.configGet("", "sops."+o.name)
+		if err != nil {
+			return err
+		}
+		oldValues = append(oldValues, other)
+		if o.name == opt {
+			other = newValue
+		}
+		newValues = append(newValues, other)
+	}
+	oldSizes, newSizes := keyGroupSizes(oldValues), keyGroupSizes(newValues)
+	for i, size := range oldSizes {
+		if size > 0 && (i >= len(newSizes) || newSizes[i] == 0) {
+			return fmt.Errorf("configured key group %d would be left without master keys", i+1)
+		}
+	}
+
+	files, err := a.matchFiles("index")
+	if err != nil {
+		return err
+	}
+	idx, err := a.s.Index()
+	if err != nil {
+		return err
+	}
+
+	updated := 0
+	for _, path := range files {
+		entry := indexEntry(idx, path, stageMerged)
+		if entry == nil {
+			continue
+		}
+		data, err := a.readBlob(entry.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "read %s", path)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		opts, err := baseOpts.forPath(path)
+		if err != nil {
+			return err
+		}
+		if opts.ruleKeys && hasKey(opts.keyGroups, key) != add {
+			// new files would be encrypted otherwise than existing ones
+			verb := "list"
+			if !add {
+				verb = "not list"
+			}
+			return fmt.Errorf("%s: creation rule in %s must %s %s, edit it first",
+				path, baseOpts.configPath, verb, key)
+		}
+		tree, err := loadEncryptedFileData(opts.inputStore, path, opts.mangling.Mangle(data, path, false))
+		if isMetaNotFound(err) {
+			log.Warnf("%s: not encrypted, skipped", path)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "load %s", path)
+		}
+
+		oldGroups := tree.Metadata.KeyGroups
+		var newGroups []sops.KeyGroup
+		changed := false
+		if add {
+			newGroups, changed = addKey(oldGroups, masterKey, group)
+		} else {
+			newGroups, changed = revokeKey(oldGroups, key)
+		}
+		if !changed {
+			continue
+		}
+		for i, g := range newGroups {
+			if len(g) == 0 {
+				return fmt.Errorf("%s: key group %d would be left without master keys", path, i+1)
+			}
+		}
+		fmt.Printf("%s:\n", path)
+		common.PrettyPrintDiffs(common.DiffKeyGroups(oldGroups, newGroups))
+		updated++
+		if dryRun {
+			continue
+		}
+
+		dataKey, err := a.getDataKey(&tree.Metadata, opts.keyServices)
+		if err != nil {
+			return errors.Wrapf(err, "%s: get data key", path)
+		}
+		tree.Metadata.KeyGroups = newGroups
+		if errs := tree.Metadata.UpdateMasterKeysWithKeyServices(dataKey, opts.keyServices); len(errs) > 0 {
+			return fmt.Errorf("%s: could not update master keys: %v", path, errs)
+		}
+		output, err := opts.outputStore.EmitEncryptedFile(*tree)
+		if err != nil {
+			return errors.Wrapf(err, "emit %s", path)
+		}
+		output = opts.mangling.Demangle(output, path, true)
+		if _, err := a.stageBlob(path, entry.Mode, output); err != nil {
+			return err
+		}
+	}
+
+	// update configured master keys
+	if newValue != value && !dryRun {
+		if err := a.setString(opt, newValue); err != nil {
+			return err
+		}
+		fmt.Printf("sops.%s = %s\n", opt, newValue)
+	}
+	if dryRun {
+		fmt.Printf("%d file(s) would be updated\n", updated)
+	} else {
+		fmt.Printf("%d file(s) updated and staged\n", updated)
+	}
+	if !add && updated > 0 {
+		// data keys are only re-wrapped, the key still decrypts them
+		log.Warnf("%s can decrypt current data keys and history, run 'git sops rotate' and 'git sops revoke %s'", key, key)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package git
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestEditKeyOption(t *testing.T) {
+	tests := []struct {
+		value string
+		key   string
+		group int
+		add   bool
+		want  string
+	}{
+		{"", "k", 0, true, "k"},
+		{"a", "k", 0, true, "a,k"},
+		{"a", "k", 1, true, "a|k"},
+		{"a", "k", 2, true, "a||k"},
+		{"a|b", "k", 1, true, "a|b,k"},
+		{"a,k|b", "k", 1, true, "a,k|b"},
+		{"a, k", "k", 0, false, "a"},
+		{"a|k", "k", 0, false, "a"},
+		{"k|a,k", "k", 0, false, "|a"},
+		{"a", "k", 0, false, "a"},
+	}
+	for _, tt := range tests {
+		got := editKeyOption(tt.value, tt.key, tt.group, tt.add)
+		if got != tt.want {
+			t.Errorf("editKeyOption(%q, %q, %d, %v) = %q, want %q",
+				tt.value, tt.key, tt.group, tt.add, got, tt.want)
+		}
+	}
+}
+
+func TestKeyGroupSizes(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"", ""}, "[0]"},
+		{[]string{"a,b", ""}, "[2]"},
+		{[]string{"k|a,k", ""}, "[1 2]"},
+		{[]string{"|a", ""}, "[0 1]"},
+		{[]string{"|a", "f"}, "[1 1]"},
+		{[]string{"a||b", "f|g"}, "[2 1 1]"},
+	}
+	for _, tt := range tests {
+		got := fmt.Sprint(keyGroupSizes(tt.values))
+		if got != tt.want {
+			t.Errorf("keyGroupSizes(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package git
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/pkg/errors"
+)
+
+// refSet lists branches and tags rewritten along with the current branch
+type refSet struct {
+	branches []*plumbing.Reference
+	tags     []*plumbing.Reference
+}
+
+// collectRefs resolves branches and tags requested by user,
+// the current branch is excluded since it's handled separately
+func (a *action) collectRefs(curBranch string, topts transformOpts) (*refSet, error) {
+	rs := &refSet{}
+	seen := map[plumbing.ReferenceName]bool{
+		plumbing.NewBranchReferenceName(curBranch): true,
+	}
+	addBranch := func(ref *plumbing.Reference) error {
+		if !seen[ref.Name()] {
+			seen[ref.Name()] = true
+			rs.branches = append(rs.branches, ref)
+		}
+		return nil
+	}
+
+	if topts.all {
+		iter, err := a.r.Branches()
+		if err != nil {
+			return nil, errors.Wrap(err, "list branches")
+		}
+		if err = iter.ForEach(addBranch); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range topts.branches {
+		ref, err := a.s.Reference(plumbing.NewBranchReferenceName(name))
+		if err != nil {
+			return nil, errors.Wrapf(err, "branch %q", name)
+		}
+		_ = addBranch(ref)
+	}
+
+	if topts.all || topts.tags {
+		iter, err := a.r.Tags()
+		if err != nil {
+			return nil, errors.Wrap(err, "list tags")
+		}
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			rs.tags = append(rs.tags, ref)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// tips returns commits that must be translated to rewrite the refs,
+// tags pointing at trees or blobs are dropped from the set
+func (rs *refSet) tips(a *action) ([]plumbing.Hash, error) {
+	var tips []plumbing.Hash
+	for _, ref := range rs.branches {
+		tips = append(tips, ref.Hash())
+	}
+	var tags []*plumbing.Reference
+	for _, ref := range rs.tags {
+		hash, err := a.peelTag(ref.Hash())
+		if err == plumbing.ErrObjectNotFound || err == object.ErrUnsupportedObject {
+			log.Warnf("tag '%s' does not point at commit, skipped", ref.Name().Short())
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve tag %q", ref.Name().Short())
+		}
+		tips = append(tips, hash)
+		tags = append(tags, ref)
+	}
+	rs.tags = tags
+	return tips, nil
+}
+
+// peelTag follows annotated tags down to the tagged commit
+func (a *action) peelTag(hash plumbing.Hash) (plumbing.Hash, error) {
+	for {
+		obj, err := a.s.EncodedObject(plumbing.AnyObject, hash)
+		if err != nil {
+			return zeroHash, err
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return hash, nil
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(a.s, obj)
+			if err != nil {
+				return zeroHash, err
+			}
+			hash = tag.Target
+		default:
+			return zeroHash, object.ErrUnsupportedObject
+		}
+	}
+}
+
+// rewriteRefs points branches and tags at translated commits
+func (t *transformer) rewriteRefs(rs *refSet, what string) error {
+	for _, ref := range rs.branches {
+		name := ref.Name().Short()
+		newHash, ok := t.commitMap[ref.Hash()]
+		if !ok {
+			return fmt.Errorf("head of branch '%s' is not translated", name)
+		}
+		newRef := plumbing.NewHashReference(ref.Name(), newHash)
+		if err := t.a.s.CheckAndSetReference(newRef, ref); err != nil {
+			return errors.Wrapf(err, "update branch %q", name)
+		}
+		// revocation leaves plain branches plain
+		if t.revoke == "" {
+			if err := t.a.markBranch(name, t.encrypt, true); err != nil {
+				return errors.Wrapf(err, "mark branch %q as encrypted=%v", name, t.encrypt)
+			}
+		}
+		fmt.Printf("%s branch '%s' at %s\n", what, name, shortHash(newHash))
+	}
+	for _, ref := range rs.tags {
+		name := ref.Name().Short()
+		newHash, err := t.translateTag(ref.Hash())
+		if err != nil {
+			return errors.Wrapf(err, "translate tag %q", name)
+		}
+		newRef := plumbing.NewHashReference(ref.Name(), newHash)
+		if err := t.a.s.CheckAndSetReference(newRef, ref); err != nil {
+			return errors.Wrapf(err, "update tag %q", name)
+		}
+		fmt.Printf("%s tag '%s' at %s\n", what, name, shortHash(newHash))
+	}
+	return nil
+}
+
+// translateTag maps a commit or annotated tag to the rewritten one,
+// annotated tags are re-created on the translated target
+func (t *transformer) translateTag(hash plumbing.Hash) (plumbing.Hash, error) {
+	if newHash, ok := t.commitMap[hash]; ok {
+		return newHash, nil
+	}
+	tag, err := object.GetTag(t.a.s, hash)
+	if err != nil {
+		return zeroHash, err
+	}
+	if tag.Target, err = t.translateTag(tag.Target); err != nil {
+		return zeroHash, err
+	}
+	if tag.PGPSignature != "" {
+		log.Warnf("signature dropped from tag '%s'", tag.Name)
+		tag.PGPSignature = ""
+	}
+	obj := t.a.s.NewEncodedObject()
+	if err := tag.Encode(obj); err != nil {
+		return zeroHash, err
+	}
+	return t.a.s.SetEncodedObject(obj)
+}
@@ -0,0 +1,127 @@
+package git
+
+import (
+	"bytes"
+
+	"go.mozilla.org/sops/v3/cmd/sops/formats"
+
+	"github.com/pkg/errors"
+)
+
+// renameThreshold is the minimal similarity of renamed files (same as git -M50%)
+const renameThreshold = 0.5
+
+// findRenameSource looks up a secret file at parentLoc which was renamed to
+// path in the worktree: the source must be gone from the worktree, have the
+// same format and have decrypted contents similar to the plain input.
+func (a *action) findRenameSource(path, parentLoc string, input []byte, baseOpts *options) (string, error) {
+	if parentLoc == "worktree" || parentLoc == "none" || parentLoc == "" {
+		return "", nil
+	}
+	loc := "index"
+	if parentLoc != "index" && parentLoc != "worktree,index" && parentLoc != "index,worktree" {
+		loc = parentLoc // commit hash
+	}
+	files, err := a.matchFiles(loc)
+	if err != nil {
+		return "", err
+	}
+	var candidates []string
+	for _, cand := range files {
+		if cand == path || !sameFormat(cand, path) {
+			continue
+		}
+		if _, err := a.readGitFile(cand, "worktree"); errors.Cause(err) != errNotFound {
+			continue // still exists, not renamed
+		}
+		candidates = append(candidates, cand)
+	}
+	best := bestRename(input, candidates, func(cand string) ([]byte, error) {
+		data, err := a.readGitFile(cand, loc)
+		if err != nil {
+			return nil, err
+		}
+		opts, err := baseOpts.forPath(cand)
+		if err != nil {
+			return nil, err
+		}
+		opts.inputData = data
+		return a.sopsDecrypt(opts)
+	})
+	return best, nil
+}
+
+// findRenameSource looks up a file in the original parent commit which was
+// renamed to path in the current commit. When encrypting the original
+// history is plain so contents are compared as is. Revoking rewrites
+// encrypted history, where similar ciphertexts tell nothing, so renames
+// aren't followed then.
+func (t *transformer) findRenameSource(path string, input []byte) (string, error) {
+	if t.oldDadHash == zeroHash || t.revoke != "" {
+		return "", nil
+	}
+	if t.renameCands == nil {
+		files, err := t.a.matchFiles(t.oldDadHash.String())
+		if err != nil {
+			return "", err
+		}
+		t.renameCands = []string{}
+		for _, cand := range files {
+			_, err := t.a.readGitFile(cand, t.curHash.String())
+			if errors.Cause(err) == errNotFound {
+				t.renameCands = append(t.renameCands, cand)
+			}
+		}
+	}
+	var candidates []string
+	for _, cand := range t.renameCands {
+		if sameFormat(cand, path) {
+			candidates = append(candidates, cand)
+		}
+	}
+	best := bestRename(input, candidates, func(cand string) ([]byte, error) {
+		return t.a.readGitFile(cand, t.oldDadHash.String())
+	})
+	return best, nil
+}
+
+// bestRename picks the candidate with plain text most similar to input
+func bestRename(input []byte, candidates []string, plainText func(path string) ([]byte, error)) string {
+	best, bestScore := "", renameThreshold
+	for _, cand := range candidates {
+		plain, err := plainText(cand)
+		if err != nil {
+			log.Debugf("rename candidate %s skipped: %v", cand, err)
+			continue
+		}
+		if score := similarity(input, plain); score >= bestScore {
+			best, bestScore = cand, score
+		}
+	}
+	if best != "" {
+		log.Debugf("rename source %s similarity %.2f", best, bestScore)
+	}
+	return best
+}
+
+// similarity returns the share of common lines in both texts from 0 to 1
+func similarity(a, b []byte) float64 {
+	linesA := bytes.Split(a, []byte("\n"))
+	linesB := bytes.Split(b, []byte("\n"))
+	count := map[string]int{}
+	for _, line := range linesA {
+		count[string(line)]++
+	}
+	common := 0
+	for _, line := range linesB {
+		if count[string(line)] > 0 {
+			count[string(line)]--
+			common++
+		}
+	}
+	return float64(2*common) / float64(len(linesA)+len(linesB))
+}
+
+func sameFormat(path1, path2 string) bool {
+	return formats.FormatForPath(path1) == formats.FormatForPath(path2)
+}
@@ -14,12 +14,21 @@ const (
 	gitFlags      = "sops.configured"
 	gitSections   = "sops filter.sops diff.sops merge.sops"
 	optThreshold  = "shamir-secret-sharing-threshold"
+	optKMS        = "kms"
+	optGcpKMS     = "gcp-kms"
+	optAzureKV    = "azure-kv"
+	optPGP        = "pgp"
+	optHcVault    = "hc-vault-transit"
+	optAge        = "age"
 	cacheTextconv = "true"
+
+	sopsConfigFileName = ".sops.yaml"
 )
 
 var gitSettings = map[string]string{
 	"filter.[driver].clean":       "[program] clean %f",
 	"filter.[driver].smudge":      "[program] smudge %f",
+	"filter.[driver].process":     "[program] filter-process",
 	"filter.[driver].required":    "true",
 	"merge.[driver].driver":       "[program] merge %P %O %A %B",
 	"merge.[driver].name":         "merge driver for secret files",
@@ -34,11 +43,20 @@ var gitAliases = map[string]string{
 	"rawlog": "! [program] rawlog --",
 }
 
-func (a *action) setupRepo(force bool, probeFile, probeText string) error {
+func (a *action) setupRepo(force bool, probeFile, probeText, detached string) error {
 	configured, _ := a.configGet("", "sops.configured")
 	if configured != "" && !force {
 		return errors.New("repository is already configured")
 	}
+	switch detached {
+	case "":
+	case detachedEncrypt, detachedDecrypt, detachedFollowUpstream, detachedError:
+		if err := a.configSet("", "sops.detached", detached); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid detached HEAD policy %q", detached)
+	}
 
 	// query previous state
 	branch, encrypted, err := a.ensureClean("", false)
@@ -46,15 +64,26 @@ func (a *action) setupRepo(force bool, probeFile, probeText string) error {
 		return err
 	}
 	repoOpts, err := a.getOptions()
-	if err == nil {
+	if err == nil && repoOpts.configPath == "" {
+		err = validateKeyGroups(repoOpts.keyGroups)
+	}
+	if err == nil && repoOpts.ageRecipients != "" && !repoOpts.noKey {
+		// collaborators without keys have no age identity
 		err = validateAgeRecipients(repoOpts.ageRecipients)
 	}
 	if err != nil {
 		return err
 	}
 
-	// validate bare sops repo by probing a file
+	// detached HEAD outside of branches keeps policy given by user
 	shouldDecrypt := false
+	if branch == "" {
+		policy, _ := a.configGet("", "sops.detached")
+		encrypted = policy == detachedEncrypt
+		shouldDecrypt = encrypted
+	}
+
+	// validate bare sops repo by probing a file
 	if probeFile != "" {
 		if probeText == "" {
 			return errors.New("--probe-file requires --probe-text")
@@ -63,14 +92,17 @@ func (a *action) setupRepo(force bool, probeFile, probeText string) error {
 		if err != nil {
 			return errors.Wrap(err, "read probe file")
 		}
-		opts := repoOpts.forPath(probeFile)
+		opts, err := repoOpts.forPath(probeFile)
+		if err != nil {
+			return err
+		}
 		opts.inputData = fileData
 		data, err := a.sopsDecrypt(opts)
 		switch {
 		case err == nil:
 			encrypted = true
 			shouldDecrypt = true
-		case isMetaNotFound(err, probeFile):
+		case isMetaNotFound(err):
 			data = fileData
 		default:
 			return errors.Wrap(err, "parse probe file")
@@ -80,11 +112,17 @@ func (a *action) setupRepo(force bool, probeFile, probeText string) error {
 		}
 	}
 
-	// reset sops settings
+	// reset sops settings, keep detached HEAD policy of CI checkouts
+	detached, _ = a.configGet("", "sops.detached")
 	_ = a.teardownRepo(true)
 	if err := repoOpts.save(); err != nil {
 		return err
 	}
+	if detached != "" {
+		if err := a.configSet("", "sops.detached", detached); err != nil {
+			return err
+		}
+	}
 
 	// safety_checks "$force" 'true'
 
@@ -120,6 +158,10 @@ func (a *action) setupRepo(force bool, probeFile, probeText string) error {
 		return err
 	}
 
+	if err = a.installHooks(program); err != nil {
+		return err
+	}
+
 	if err = os.Chmod(a.dotGit("config"), permSecret); err != nil {
 		return err
 	}
@@ -168,6 +210,7 @@ func (a *action) teardownRepo(quiet bool) error {
 	for _, flag := range strings.Split(gitFlags, " ") {
 		_ = a.configUnset("", flag)
 	}
+	a.removeHooks()
 
 	// forceCheckout
 	if !quiet {
@@ -183,5 +226,15 @@ func (a *action) showStatus() error {
 	fmt.Printf("configured: %v\n", configured == "true")
 	fmt.Printf("branch:     %s\n", branch)
 	fmt.Printf("encrypted:  %v\n", encrypted)
+	if noKey, _ := a.getBool("no-key", optUseGit); noKey {
+		fmt.Printf("no-key:     %v\n", noKey)
+	}
+	locked, err := a.listLocked()
+	if err != nil {
+		return err
+	}
+	for _, path := range locked {
+		fmt.Printf("locked:     %s\n", path)
+	}
 	return nil
 }
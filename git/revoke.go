@@ -0,0 +1,218 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/go-git/go-git/v5/plumbing"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/aes"
+	"go.mozilla.org/sops/v3/keys"
+)
+
+// revokeRecipient rewrites history of all branches and tags, or of the
+// current branch and those requested, so that no secret file stays
+// encrypted for the recipient
+func (a *action) revokeRecipient(recipient string, topts transformOpts) error {
+	topts.revoke = recipient
+	if !topts.multiRef() {
+		topts.all = true
+	}
+	return a.transformBranch("", true, topts)
+}
+
+// revokeFile re-encrypts the file for its key groups without the revoked
+// recipient. Data key is taken from the rewritten dad file if this run has
+// generated it for the same master keys, otherwise a fresh one is generated.
+// Dad's master keys come along, as they hold encrypted copies of its data
+// key. Files not encrypted for the recipient are left as is.
+func (t *transformer) revokeFile(job *fileJob) ([]byte, error) {
+	path, input, opts := job.path, job.srcData, job.opts
+	tree, err := loadEncryptedFileData(opts.inputStore, path, opts.mangling.Mangle(input, path, false))
+	if isMetaNotFound(err) {
+		return input, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	groups, found := revokeKey(tree.Metadata.KeyGroups, t.revoke)
+	if !found {
+		return input, nil
+	}
+	for i, group := range groups {
+		if len(group) == 0 {
+			return nil, fmt.Errorf("key group %d would be left without master keys", i+1)
+		}
+	}
+
+	// decrypt with separate cipher, IVs of old data key are not reused
+	opts.renameKeys = nil
+	plainOpts := *opts
+	plainOpts.cipher = aes.NewCipher()
+	plainOpts.inputData = input
+	plain, err := t.a.sopsDecrypt(&plainOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.meta = tree.Metadata
+	opts.meta.KeyGroups = groups
+	opts.meta.DataKey = nil
+	if job.dadData != nil {
+		dadMeta, err := extractMetadata(job.dadPath, job.dadData, opts)
+		if err != nil {
+			log.Debugf("%s:%s no dad metadata: %v", job.commit, path, err)
+		}
+		if dadMeta != nil && t.isFreshKey(dadMeta.DataKey) && sameMasterKeys(dadMeta.KeyGroups, groups) {
+			opts.meta.DataKey = dadMeta.DataKey
+			opts.meta.KeyGroups = dadMeta.KeyGroups
+
+			// compare with dad, seed cipher stash with dad values
+			opts.inputData = job.dadData
+			plainDad, err := t.a.sopsDecrypt(opts)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(plain, plainDad) {
+				return job.dadData, nil
+			}
+		}
+	}
+
+	opts.inputData = plain
+	output, err := t.a.sopsEncrypt(opts)
+	if err != nil {
+		return nil, err
+	}
+	t.addFreshKey(opts.meta.DataKey)
+	log.Debugf("%s:%s revoked %s %s", job.commit, path, t.revoke, traceData(input, output, nil))
+	return output, nil
+}
+
+func (t *transformer) isFreshKey(dataKey []byte) bool {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	return t.freshKeys[string(dataKey)]
+}
+
+func (t *transformer) addFreshKey(dataKey []byte) {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+	t.freshKeys[string(dataKey)] = true
+}
+
+// reportRevoked lists files re-encrypted without the revoked recipient
+func (t *transformer) reportRevoked() {
+	var paths []string
+	blobs := 0
+	for path, count := range t.revoked {
+		paths = append(paths, path)
+		blobs += count
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Printf("  %s: %d blob(s)\n", path, t.revoked[path])
+	}
+	commits := 0
+	for oldHash, newHash := range t.commitMap {
+		if oldHash != newHash {
+			commits++
+		}
+	}
+	fmt.Printf("revoked %s from %d blob(s) of %d file(s) in %d commit(s)\n",
+		t.revoke, blobs, len(paths), commits)
+	if commits > 0 {
+		fmt.Println("force-push rewritten branches and tags to complete revocation")
+	}
+	stale, err := t.staleRefs()
+	if err != nil {
+		log.Warnf("cannot list refs: %v", err)
+	}
+	for _, name := range stale {
+		log.Warnf("'%s' is not rewritten and may keep %s", name, t.revoke)
+	}
+	if _, found := revokeKey(t.baseOpts.keyGroups, t.revoke); found {
+		log.Warnf("%s is still configured for new files", t.revoke)
+	}
+}
+
+// staleRefs lists local branches and tags pointing at commits
+// which this run has not produced
+func (t *transformer) staleRefs() ([]string, error) {
+	rewritten := map[plumbing.Hash]bool{}
+	for _, newHash := range t.commitMap {
+		rewritten[newHash] = true
+	}
+	refs, err := t.a.r.References()
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name()
+		if ref.Type() != plumbing.HashReference || !(name.IsBranch() || name.IsTag()) {
+			return nil
+		}
+		hash, err := t.a.peelTag(ref.Hash())
+		if err != nil {
+			return nil // tags of trees and blobs have no secret files
+		}
+		if !rewritten[hash] && name.Short() != t.tmpBranch {
+			stale = append(stale, name.Short())
+		}
+		return nil
+	})
+	sort.Strings(stale)
+	return stale, err
+}
+
+// revokeKey returns copy of key groups without the master key
+func revokeKey(groups []sops.KeyGroup, recipient string) ([]sops.KeyGroup, bool) {
+	found := false
+	var result []sops.KeyGroup
+	for _, group := range groups {
+		var kept sops.KeyGroup
+		for _, key := range group {
+			if key.ToString() == recipient {
+				found = true
+				continue
+			}
+			kept = append(kept, key)
+		}
+		result = append(result, kept)
+	}
+	return result, found
+}
+
+// sameMasterKeys tells whether key groups list the same master keys
+// in the same order, encrypted data keys and their dates may differ
+func sameMasterKeys(a, b []sops.KeyGroup) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if !reflect.DeepEqual(masterKeyFields(a[i][j]), masterKeyFields(b[i][j])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// masterKeyFields describes the master key without its encrypted data key
+func masterKeyFields(key keys.MasterKey) map[string]interface{} {
+	fields := map[string]interface{}{"type": fmt.Sprintf("%T", key)}
+	for name, value := range key.ToMap() {
+		if name != "enc" && name != "created_at" {
+			fields[name] = value
+		}
+	}
+	return fields
+}
@@ -0,0 +1,86 @@
+package git
+
+import (
+	"strings"
+	"testing"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/pgp"
+)
+
+// keyGroups builds groups of pgp keys from "a,b|c" notation
+func keyGroups(value string) []sops.KeyGroup {
+	var groups []sops.KeyGroup
+	for _, part := range strings.Split(value, groupSeparator) {
+		group := sops.KeyGroup{}
+		for _, fp := range splitList(part) {
+			group = append(group, pgp.NewMasterKeyFromFingerprint(fp))
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// groupsString formats key groups back to "a,b|c" notation
+func groupsString(groups []sops.KeyGroup) string {
+	var parts []string
+	for _, group := range groups {
+		var fps []string
+		for _, key := range group {
+			fps = append(fps, key.ToString())
+		}
+		parts = append(parts, strings.Join(fps, ","))
+	}
+	return strings.Join(parts, groupSeparator)
+}
+
+func TestRevokeKey(t *testing.T) {
+	tests := []struct {
+		groups    string
+		recipient string
+		want      string
+		found     bool
+	}{
+		{"A,B", "A", "B", true},
+		{"A,B", "C", "A,B", false},
+		{"A|B,C", "B", "A|C", true},
+		{"A,B|A,C", "A", "B|C", true},
+		{"A|B", "B", "A|", true},
+		{"AB,B", "A", "AB,B", false},
+	}
+	for _, tt := range tests {
+		got, found := revokeKey(keyGroups(tt.groups), tt.recipient)
+		if gotStr := groupsString(got); gotStr != tt.want || found != tt.found {
+			t.Errorf("revokeKey(%q, %q) = %q, %v, want %q, %v",
+				tt.groups, tt.recipient, gotStr, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestSameMasterKeys(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"A,B", "A,B", true},
+		{"A,B|C", "A,B|C", true},
+		{"A,B", "B,A", false},
+		{"A,B|C", "B,A|C", false},
+		{"A,B", "A", false},
+		{"A,B", "A,C", false},
+		{"A|B", "B|A", false},
+		{"A|B", "A", false},
+	}
+	for _, tt := range tests {
+		// encrypted data keys don't matter
+		b := keyGroups(tt.b)
+		for _, group := range b {
+			for _, key := range group {
+				key.SetEncryptedDataKey([]byte("other data key"))
+			}
+		}
+		if got := sameMasterKeys(keyGroups(tt.a), b); got != tt.want {
+			t.Errorf("sameMasterKeys(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
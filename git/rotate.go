@@ -0,0 +1,154 @@
+package git
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"go.mozilla.org/sops/v3"
+
+	"github.com/pkg/errors"
+)
+
+const rotateMessage = "Rotate data keys"
+
+// rotateKeys re-encrypts secret files of the index with new data keys and
+// commits them at once. Files are cleaned without parent, so they get new
+// data keys and master keys currently configured. With ifNeeded only files
+// having master keys which need rotation are re-encrypted.
+func (a *action) rotateKeys(ifNeeded bool, message string) error {
+	_, encrypted, err := a.ensureClean("", false)
+	if err != nil {
+		return err
+	}
+	if !encrypted {
+		return errors.New("current branch is not encrypted")
+	}
+	files, err := a.matchFiles("index")
+	if err != nil {
+		return err
+	}
+	baseOpts, err := a.filterOptions(true)
+	if err != nil {
+		return err
+	}
+	idx, err := a.s.Index()
+	if err != nil {
+		return err
+	}
+
+	// re-encrypt all files first, so that nothing is staged on failure
+	type rotation struct {
+		path  string
+		entry *index.Entry
+		data  []byte
+	}
+	var rotations []rotation
+	for _, path := range files {
+		entry := indexEntry(idx, path, stageMerged)
+		if entry == nil {
+			continue
+		}
+		data, err := a.readBlob(entry.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "read %s", path)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		opts, err := baseOpts.forPath(path)
+		if err != nil {
+			return err
+		}
+		tree, err := loadEncryptedFileData(opts.inputStore, path, opts.mangling.Mangle(data, path, false))
+		if isMetaNotFound(err) {
+			log.Warnf("%s: not encrypted, skipped", path)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "load %s", path)
+		}
+		if ifNeeded && !needsRotation(&tree.Metadata) {
+			log.Debugf("%s: data key is fresh", path)
+			continue
+		}
+
+		opts.inputData = data
+		plain, err := a.sopsDecrypt(opts)
+		if err != nil {
+			return errors.Wrapf(err, "decrypt %s", path)
+		}
+		output, err := a.cleanData(path, plain, true, "none", "")
+		if err != nil {
+			return errors.Wrapf(err, "encrypt %s", path)
+		}
+		rotations = append(rotations, rotation{path: path, entry: entry, data: output})
+	}
+	if len(rotations) == 0 {
+		fmt.Println("no data keys to rotate")
+		return nil
+	}
+
+	// stage and commit, restore staged entries if that fails
+	var staged []rotation
+	restore := func() {
+		for _, r := range staged {
+			if err := a.stageHash(r.path, r.entry.Mode, r.entry.Hash); err != nil {
+				log.Warnf("%v", err)
+			}
+		}
+	}
+	for _, r := range rotations {
+		hash, err := a.stageBlob(r.path, r.entry.Mode, r.data)
+		if err != nil {
+			restore()
+			return err
+		}
+		staged = append(staged, r)
+		log.Debugf("%s: rotated %s -> %s", r.path, shortHash(r.entry.Hash), shortHash(hash))
+	}
+	if message == "" {
+		message = rotateMessage
+	}
+	if _, err := execArgs([]string{"git", "commit", "-q", "-m", message}, false, nil); err != nil {
+		restore()
+		return err
+	}
+	_, _ = execCommand("git update-index -q --refresh", false, nil)
+	for _, r := range rotations {
+		fmt.Println(r.path)
+	}
+	fmt.Printf("rotated data keys of %d file(s)\n", len(rotations))
+	return nil
+}
+
+// stageBlob writes file data to git storage and puts it in the index
+func (a *action) stageBlob(path string, mode filemode.FileMode, data []byte) (plumbing.Hash, error) {
+	hash, err := a.writeGitBlob(data)
+	if err != nil {
+		return zeroHash, err
+	}
+	return hash, a.stageHash(path, mode, hash)
+}
+
+// stageHash puts the blob in the index
+func (a *action) stageHash(path string, mode filemode.FileMode, hash plumbing.Hash) error {
+	cacheInfo := fmt.Sprintf("%o,%s,%s", uint32(mode), hash, path)
+	if _, err := execArgs([]string{"git", "update-index", "--cacheinfo", cacheInfo}, false, nil); err != nil {
+		return errors.Wrapf(err, "stage %s", path)
+	}
+	return nil
+}
+
+// needsRotation tells whether any master key of the file is stale
+func needsRotation(meta *sops.Metadata) bool {
+	for _, group := range meta.KeyGroups {
+		for _, key := range group {
+			if key.NeedsRotation() {
+				return true
+			}
+		}
+	}
+	return false
+}
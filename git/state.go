@@ -0,0 +1,194 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// sequencerState is an operation of git which may detach HEAD
+type sequencerState struct {
+	name     string
+	marker   string   // file or directory present during the operation
+	headName string   // file keeping the branch name, if any
+	starts   []string // files keeping commits where operation started
+	rebasing bool
+}
+
+// sequencerStates are checked in order, rebase comes first because
+// its steps run cherry-pick and am
+var sequencerStates = []sequencerState{
+	{"rebase", "rebase-merge", "rebase-merge/head-name", []string{"rebase-merge/orig-head"}, true},
+	{"rebase", "rebase-apply/rebasing", "rebase-apply/head-name", []string{"ORIG_HEAD"}, true},
+	{"am", "rebase-apply/applying", "", []string{"ORIG_HEAD"}, false},
+	{"cherry-pick", "CHERRY_PICK_HEAD", "", []string{"sequencer/head", "HEAD"}, false},
+	{"revert", "REVERT_HEAD", "", []string{"sequencer/head", "HEAD"}, false},
+	{"sequence", "sequencer", "", []string{"sequencer/head"}, false},
+	{"bisect", "BISECT_START", "BISECT_START", nil, false},
+}
+
+// detachedBranch finds the branch which an operation in progress has
+// detached HEAD from. Branch name is recorded by rebase and bisect,
+// otherwise it's looked up by the branch tip where operation started.
+func (a *action) detachedBranch() (ref plumbing.ReferenceName, rebasing bool, err error) {
+	for _, state := range sequencerStates {
+		if _, err := os.Stat(a.dotGit(filepath.FromSlash(state.marker))); err != nil {
+			continue
+		}
+		ref = ""
+		if state.headName != "" {
+			buf, _ := ioutil.ReadFile(a.dotGit(filepath.FromSlash(state.headName)))
+			ref = plumbing.ReferenceName(strings.TrimSpace(string(buf)))
+			if ref != "" && !strings.HasPrefix(ref.String(), "refs/") {
+				ref = plumbing.NewBranchReferenceName(ref.String())
+			}
+		}
+		if !ref.IsBranch() {
+			// rebase --apply writes head name only when it stops
+			var starts []plumbing.Hash
+			for _, name := range state.starts {
+				starts = append(starts, a.readHash(name))
+			}
+			ref = a.branchAt(starts...)
+		}
+		if !ref.IsBranch() {
+			continue // nested operation may know the branch
+		}
+		log.Debugf("%s in progress on '%s'", state.name, ref.Short())
+		return ref, state.rebasing, nil
+	}
+	return "", false, errNoBranch
+}
+
+// readHash reads commit hash from a file in git directory
+func (a *action) readHash(name string) plumbing.Hash {
+	buf, err := ioutil.ReadFile(a.dotGit(filepath.FromSlash(name)))
+	if err != nil {
+		return zeroHash
+	}
+	return plumbing.NewHash(strings.TrimSpace(string(buf)))
+}
+
+// branchAt returns the first local branch pointing at one of the commits
+func (a *action) branchAt(hashes ...plumbing.Hash) plumbing.ReferenceName {
+	branches, err := a.r.Branches()
+	if err != nil {
+		return ""
+	}
+	tips := map[plumbing.Hash]plumbing.ReferenceName{}
+	_ = branches.ForEach(func(ref *plumbing.Reference) error {
+		if _, ok := tips[ref.Hash()]; !ok {
+			tips[ref.Hash()] = ref.Name()
+		}
+		return nil
+	})
+	for _, hash := range hashes {
+		if ref, ok := tips[hash]; ok && hash != zeroHash {
+			return ref
+		}
+	}
+	return ""
+}
+
+// detached HEAD policies, see sops.detached
+const (
+	detachedEncrypt        = "encrypt"
+	detachedDecrypt        = "decrypt"
+	detachedFollowUpstream = "follow-upstream"
+	detachedError          = "error"
+)
+
+// detachedPolicy handles HEAD detached outside of git operations,
+// e.g. by CI checkouts. Depending on sops.detached setting, the commit
+// is always filtered as encrypted or not, follows the branch it belongs
+// to (default) or fails.
+func (a *action) detachedPolicy(hash plumbing.Hash) (ref plumbing.ReferenceName, policy string, err error) {
+	if policy, err = a.configGet("", "sops.detached"); err != nil {
+		return "", "", err
+	}
+	switch policy {
+	case detachedEncrypt, detachedDecrypt:
+		log.Debugf("detached HEAD, policy %s", policy)
+		return "", policy, nil
+	case detachedFollowUpstream, "":
+		if ref = a.containingBranch(hash); ref == "" {
+			return "", "", errNoBranch
+		}
+		log.Debugf("detached HEAD belongs to '%s'", ref.Short())
+		return ref, detachedFollowUpstream, nil
+	case detachedError:
+		return "", "", errNoBranch
+	}
+	return "", "", fmt.Errorf("invalid sops.detached policy %q", policy)
+}
+
+// containingBranch finds the branch a detached commit belongs to.
+// Branches pointing at the commit are preferred to those containing it,
+// local branches to remote ones. Remote branches are mapped to the local
+// branches tracking them, or to the local branch of the same name.
+func (a *action) containingBranch(hash plumbing.Hash) plumbing.ReferenceName {
+	refs, err := a.r.References()
+	if err != nil {
+		return ""
+	}
+	var local, remote []*plumbing.Reference
+	_ = refs.ForEach(func(ref *plumbing.Reference) error {
+		switch {
+		case ref.Type() != plumbing.HashReference:
+		case ref.Name().IsBranch():
+			local = append(local, ref)
+		case ref.Name().IsRemote():
+			remote = append(remote, ref)
+		}
+		return nil
+	})
+	candidates := append(local, remote...)
+
+	found := func(ref *plumbing.Reference) plumbing.ReferenceName {
+		if ref.Name().IsBranch() {
+			return ref.Name()
+		}
+		return a.trackingBranch(ref.Name())
+	}
+	for _, ref := range candidates {
+		if ref.Hash() == hash {
+			return found(ref)
+		}
+	}
+	commit, err := a.r.CommitObject(hash)
+	if err != nil {
+		return ""
+	}
+	for _, ref := range candidates {
+		tip, err := a.r.CommitObject(ref.Hash())
+		if err != nil {
+			continue
+		}
+		if ok, _ := commit.IsAncestor(tip); ok {
+			return found(ref)
+		}
+	}
+	return ""
+}
+
+// trackingBranch maps remote branch to the local branch following it
+func (a *action) trackingBranch(remoteRef plumbing.ReferenceName) plumbing.ReferenceName {
+	short := remoteRef.Short() // e.g. origin/main
+	slash := strings.IndexByte(short, '/')
+	if slash < 0 {
+		return ""
+	}
+	remote, name := short[:slash], short[slash+1:]
+	if cfg, err := a.r.Config(); err == nil {
+		for _, branch := range cfg.Branches {
+			if branch.Remote == remote && branch.Merge == plumbing.NewBranchReferenceName(name) {
+				return plumbing.NewBranchReferenceName(branch.Name)
+			}
+		}
+	}
+	return plumbing.NewBranchReferenceName(name)
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5"
@@ -18,6 +20,7 @@ type transformer struct {
 	a          *action
 	encrypt    bool
 	progress   bool
+	jobs       int
 	curBranch  string
 	tmpBranch  string
 	restoreCur bool
@@ -29,11 +32,80 @@ type transformer struct {
 	newDadHash plumbing.Hash
 	baseOpts   *options
 	startAt    time.Time
-	transCache map[plumbing.Hash]plumbing.Hash
+	journal    *journal
+	history    *historyMap
+	commitMap  map[plumbing.Hash]plumbing.Hash
+	transCache map[transKey]plumbing.Hash
 	treeCache  map[string]*object.Tree
+	matchCache map[plumbing.Hash][]string
+	// files deleted since the first parent, nil until needed
+	renameCands []string
+	// recipient revocation
+	revoke    string
+	revoked   map[string]int  // re-encrypted blobs per path
+	freshKeys map[string]bool // data keys generated by this run
+	keysMu    sync.Mutex
+	// import from cryptor.sh
+	ivacrypt *ivacrypt
 }
 
-const gitPruneWorkaround = false
+// transformOpts are user options of history transformation
+type transformOpts struct {
+	force    bool
+	progress bool
+	resume   bool      // continue interrupted run from journal
+	jobs     int       // number of parallel workers, zero means all CPUs
+	all      bool      // rewrite all local branches and tags
+	tags     bool      // rewrite all tags
+	branches []string  // rewrite these branches too
+	full     bool      // ignore commits translated by previous runs
+	revoke   string    // re-encrypt history without this recipient
+	ivacrypt *ivacrypt // import files encrypted by cryptor.sh
+}
+
+// multiRef tells whether other refs are rewritten with the current branch
+func (o transformOpts) multiRef() bool {
+	return o.all || o.tags || len(o.branches) > 0
+}
+
+// direction names the transformation in journal
+func (o transformOpts) direction(encrypt bool) string {
+	if o.revoke != "" {
+		return "revoke:" + o.revoke
+	}
+	if o.ivacrypt != nil {
+		return "import-ivacrypt"
+	}
+	return directionName(encrypt)
+}
+
+// transKey identifies a blob transformation, the result depends
+// on file path via creation rules, data keys and store format
+type transKey struct {
+	path string
+	hash plumbing.Hash
+}
+
+// fileJob is a conversion of secret file. Git storage is not safe for
+// concurrent use, so it's accessed serially before and after conversion
+// while the conversion itself runs in the pool of workers.
+type fileJob struct {
+	path    string
+	commit  string // short hash for logs
+	key     transKey
+	entry   *object.TreeEntry // nil when prefetching
+	opts    *options
+	srcData []byte
+	dadPath string
+	dadData []byte
+	dstData []byte
+	err     error
+}
+
+const (
+	gitPruneWorkaround = false
+	prefetchBatchSize  = 256
+)
 
 func (t *transformer) finalize() {
 	if t.restoreCur {
@@ -47,10 +119,20 @@ func (t *transformer) finalize() {
 	}
 }
 
-func (a *action) transformBranch(newBranch string, encrypt, force, progress bool) error {
+func (a *action) transformBranch(newBranch string, encrypt bool, topts transformOpts) error {
+	// recover after interrupted run
+	var jrn *journal
+	if topts.resume {
+		var err error
+		if jrn, err = a.resumeJournal(topts.direction(encrypt)); err != nil {
+			return err
+		}
+		defer jrn.close()
+	}
+
 	// check that worktree is clean
 	curBranch, wasEncrypted, err := a.ensureClean("", false)
-	if err == errIsDirty && force {
+	if err == errIsDirty && topts.force {
 		log.Warn("forcing rewrite on dirty repository")
 		err = nil
 	}
@@ -63,7 +145,15 @@ func (a *action) transformBranch(newBranch string, encrypt, force, progress bool
 	if encrypt {
 		what = "encrypted"
 	}
-	if encrypt == wasEncrypted && !force {
+	switch {
+	case topts.revoke != "":
+		if !wasEncrypted {
+			return errors.New("current branch is not encrypted")
+		}
+		what = "rewritten"
+	case topts.ivacrypt != nil:
+		what = "imported"
+	case encrypt == wasEncrypted && !topts.force && !topts.multiRef():
 		log.Warnf("the branch is already %s", what)
 		return nil
 	}
@@ -74,8 +164,11 @@ func (a *action) transformBranch(newBranch string, encrypt, force, progress bool
 		newBranch = curBranch
 	}
 	if newBranch != curBranch {
+		if topts.multiRef() {
+			return errors.New("cannot rewrite other branches or tags to new branch")
+		}
 		where = "to new"
-		if _, err := a.r.Branch(newBranch); err == nil && !force {
+		if _, err := a.r.Branch(newBranch); err == nil && !topts.force {
 			return errors.New("target branch already exists")
 		}
 	}
@@ -90,8 +183,21 @@ func (a *action) transformBranch(newBranch string, encrypt, force, progress bool
 		}
 	}
 
-	// obtain and validate the branch commit log on clear repo
-	hashLog, err := a.commitLog()
+	// obtain and validate the commit log of all refs on clear repo
+	headRef, err := a.r.Head()
+	if err != nil {
+		return err
+	}
+	oldHead := headRef.Hash()
+	refs, err := a.collectRefs(curBranch, topts)
+	if err != nil {
+		return err
+	}
+	tips, err := refs.tips(a)
+	if err != nil {
+		return err
+	}
+	hashLog, err := a.topoSort(append([]plumbing.Hash{oldHead}, tips...))
 	if err != nil {
 		return err
 	}
@@ -103,6 +209,9 @@ func (a *action) transformBranch(newBranch string, encrypt, force, progress bool
 		}
 		log.Debugf("verified commit %d/%d %s %q", i+1, len(hashLog), shortHash, msg)
 	}
+	if jrn != nil && (jrn.branch != curBranch || jrn.head != oldHead) {
+		return fmt.Errorf("branch '%s' has changed since interrupted run, start anew without --resume", jrn.branch)
+	}
 
 	// worktree is unused, ignore file modtime
 	baseOpts, err := a.getOptions()
@@ -120,34 +229,92 @@ func (a *action) transformBranch(newBranch string, encrypt, force, progress bool
 		a:          a,
 		baseOpts:   baseOpts,
 		encrypt:    encrypt,
-		progress:   progress,
+		progress:   topts.progress,
+		jobs:       topts.jobs,
 		hashLog:    hashLog,
 		curBranch:  curBranch,
 		tmpBranch:  tmpBranch,
 		restoreCur: true,
 		deleteTemp: true,
-		transCache: map[plumbing.Hash]plumbing.Hash{},
+		journal:    jrn,
+		history:    a.newHistoryMap(),
+		commitMap:  map[plumbing.Hash]plumbing.Hash{},
+		transCache: map[transKey]plumbing.Hash{},
+		matchCache: map[plumbing.Hash][]string{},
+		revoke:     topts.revoke,
+		revoked:    map[string]int{},
+		freshKeys:  map[string]bool{},
+		ivacrypt:   topts.ivacrypt,
 	}
 	defer t.finalize()
+	if t.jobs <= 0 {
+		t.jobs = runtime.NumCPU()
+	}
+	if t.journal == nil {
+		if t.journal, err = a.createJournal(topts.direction(encrypt), oldHead, curBranch); err != nil {
+			return err
+		}
+		defer t.journal.close()
+	} else {
+		for key, hash := range t.journal.blobs {
+			t.transCache[key] = hash
+		}
+		log.Infof("resuming after %d commit(s) and %d file(s) done",
+			len(t.journal.commits), len(t.journal.blobs))
+	}
+	if !topts.full || t.revoke != "" {
+		// revocation moves pairs of previous runs to rewritten commits
+		if t.history, err = a.loadHistoryMap(); err != nil {
+			return err
+		}
+	}
 
-	// traverse commit log
+	// decrypted blobs do not depend on parent commits, convert them all at once
 	t.startAt = time.Now()
-	t.oldDadHash = zeroHash
-	t.newDadHash = zeroHash
+	if !t.encrypt {
+		if err := t.prefetchBlobs(); err != nil {
+			return err
+		}
+	}
+
+	// traverse commit graph, parents go first
 	for i, hash := range t.hashLog {
 		t.curHash = hash
 		t.shortHash = shortHash(hash)
 		t.reportProgress(i + 1)
+		if newHash, ok := t.knownCommit(hash); ok {
+			t.commitMap[hash] = newHash
+			log.Debugf("~ commit reused: %s -> %s", t.shortHash, shortHash(newHash))
+			continue
+		}
 		newHash, err := t.transformCommit()
 		if err != nil {
 			return errors.Wrapf(err, "convert commit %s", t.shortHash)
 		}
-		t.oldDadHash = hash
-		t.newDadHash = newHash
+		t.commitMap[hash] = newHash
+		if err := t.journal.addCommit(hash, newHash); err != nil {
+			return err
+		}
 		log.Debugf("~ commit transformed: %s -> %s", t.shortHash, shortHash(newHash))
 	}
 	t.reportProgress(-1)
-	newHead := t.newDadHash
+	newHead := t.commitMap[oldHead]
+	switch {
+	case t.revoke != "":
+		err = t.history.remap(t.commitMap)
+	case t.ivacrypt != nil:
+		// imported commits have no plain counterparts
+	default:
+		err = t.history.save(t.commitMap, t.encrypt)
+	}
+	if err != nil {
+		log.Warnf("cannot save history map: %v", err)
+	}
+
+	// point other branches and tags at translated commits
+	if err := t.rewriteRefs(refs, what); err != nil {
+		return err
+	}
 
 	// switch to resulting branch
 	log.Debugf("switching branch %s -> %s at %s", tmpBranch, newBranch, shortHash(newHead))
@@ -157,7 +324,13 @@ func (a *action) transformBranch(newBranch string, encrypt, force, progress bool
 	}
 	t.restoreCur = false
 	t.deleteTemp = true
+	if err := t.journal.remove(); err != nil {
+		log.Warnf("cannot remove journal: %v", err)
+	}
 	fmt.Printf("%s %s branch '%s' at %s\n", what, where, newBranch, shortHash(newHead))
+	if t.revoke != "" {
+		t.reportRevoked()
+	}
 	return nil
 }
 
@@ -173,6 +346,19 @@ func (t *transformer) transformCommit() (plumbing.Hash, error) {
 	}
 	oldTreeHash := tree.Hash
 
+	// translate parents, the first one provides data keys
+	newParents, err := t.translateParents(commit.ParentHashes)
+	if err != nil {
+		return zeroHash, err
+	}
+	t.oldDadHash = zeroHash
+	t.newDadHash = zeroHash
+	if len(newParents) > 0 {
+		t.oldDadHash = commit.ParentHashes[0]
+		t.newDadHash = newParents[0]
+	}
+	t.renameCands = nil
+
 	// collect source trees
 	t.treeCache = map[string]*object.Tree{}
 	if err := t.collectTrees("", tree); err != nil {
@@ -180,15 +366,26 @@ func (t *transformer) transformCommit() (plumbing.Hash, error) {
 	}
 	t.treeCache[""] = tree
 
-	// transform tree files
-	matchingFiles, err := t.a.matchFiles(t.curHash.String())
+	// transform tree files, conversions run in parallel
+	matchingFiles, err := t.matchFiles(t.curHash)
 	if err != nil {
-		return zeroHash, errors.Wrapf(err, "match source files in %s", t.shortHash)
+		return zeroHash, err
 	}
+	var jobs []*fileJob
 	for _, path := range matchingFiles {
-		if err := t.transformFile(path); err != nil {
+		job, err := t.prepareEntry(path)
+		if err != nil {
 			return zeroHash, errors.Wrapf(err, "transform file %s in %s", path, t.shortHash)
 		}
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	t.runJobs(jobs)
+	for _, job := range jobs {
+		if err := t.storeFile(job); err != nil {
+			return zeroHash, err
+		}
 	}
 
 	// update tree hashes
@@ -201,10 +398,7 @@ func (t *transformer) transformCommit() (plumbing.Hash, error) {
 
 	// update commit object
 	commit.TreeHash = newTreeHash
-	commit.ParentHashes = nil
-	if t.newDadHash != zeroHash {
-		commit.ParentHashes = []plumbing.Hash{t.newDadHash}
-	}
+	commit.ParentHashes = newParents
 	var newHash plumbing.Hash
 	store := t.a.s
 	obj := store.NewEncodedObject()
@@ -217,71 +411,254 @@ func (t *transformer) transformCommit() (plumbing.Hash, error) {
 	return newHash, nil
 }
 
-func (t *transformer) transformFile(filePath string) error {
+// translateParents maps old parent hashes to the rewritten ones
+func (t *transformer) translateParents(oldParents []plumbing.Hash) ([]plumbing.Hash, error) {
+	var newParents []plumbing.Hash
+	for _, oldHash := range oldParents {
+		newHash, ok := t.commitMap[oldHash]
+		if !ok {
+			return nil, fmt.Errorf("parent %s of %s is not translated", shortHash(oldHash), t.shortHash)
+		}
+		newParents = append(newParents, newHash)
+	}
+	return newParents, nil
+}
+
+// knownCommit looks up commit translated by interrupted or previous run
+func (t *transformer) knownCommit(hash plumbing.Hash) (plumbing.Hash, bool) {
+	if newHash, ok := t.journal.commits[hash]; ok {
+		return newHash, true
+	}
+	if newHash, ok := t.history.lookup(hash, t.encrypt); ok && t.revoke == "" && t.ivacrypt == nil {
+		// the result might have been pruned by git gc
+		return newHash, t.a.s.HasEncodedObject(newHash) == nil
+	}
+	return zeroHash, false
+}
+
+// matchFiles returns secret files of a commit, results are cached
+// since decryption walks the history twice
+func (t *transformer) matchFiles(hash plumbing.Hash) ([]string, error) {
+	if files, ok := t.matchCache[hash]; ok {
+		return files, nil
+	}
+	var files []string
+	var err error
+	if t.ivacrypt != nil {
+		files, err = t.a.matchIvacrypt(hash.String())
+	} else {
+		files, err = t.a.matchFiles(hash.String())
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "match source files in %s", shortHash(hash))
+	}
+	t.matchCache[hash] = files
+	return files, nil
+}
+
+// prepareEntry finds file entry in the current tree and either
+// replaces its hash from cache or returns a conversion job for it
+func (t *transformer) prepareEntry(filePath string) (*fileJob, error) {
 	// get source tree
 	parentPath := path.Dir(filePath)
+	if parentPath == "." {
+		parentPath = "" // root tree
+	}
 	fileName := path.Base(filePath)
 	fileTree := t.treeCache[parentPath]
 	if fileTree == nil {
-		return errors.New("get source tree")
+		return nil, errors.New("get source tree")
 	}
 
 	// get file entry
 	entry, err := fileTree.FindEntry(fileName)
 	if err != nil {
-		return errors.Wrap(err, "get source hash")
+		return nil, errors.Wrap(err, "get source hash")
 	}
 	if !entry.Mode.IsFile() || entry.Mode == filemode.Symlink {
-		return errors.New("source is not a file")
+		return nil, errors.New("source is not a file")
 	}
 	log.Debugf("file1 tree %q [%s]", parentPath, traceTree(fileTree))
 
 	// look up result in the transformation cache
 	srcHash := entry.Hash
-	dstHash := t.transCache[srcHash]
+	dstHash := t.transCache[transKey{path: filePath, hash: srcHash}]
 	if dstHash != zeroHash {
 		entry.Hash = dstHash
 		log.Debugf("%s:%s cache hit %s -> %s",
 			t.shortHash, filePath, shortHash(srcHash), shortHash(dstHash))
-		return nil
+		return nil, nil
 	}
 
-	// get source data
-	var srcText string
-	file, err := fileTree.File(fileName)
-	if err == nil {
-		srcText, err = file.Contents()
+	job, err := t.prepareFile(filePath, srcHash)
+	if err != nil {
+		return nil, err
+	}
+	job.entry = entry
+	return job, nil
+}
+
+// prepareFile reads everything the conversion needs from git storage
+func (t *transformer) prepareFile(filePath string, srcHash plumbing.Hash) (*fileJob, error) {
+	job := &fileJob{
+		path:   filePath,
+		commit: t.shortHash,
+		key:    transKey{path: filePath, hash: srcHash},
+	}
+	var err error
+	if job.srcData, err = t.a.readBlob(srcHash); err != nil {
+		return nil, errors.Wrap(err, "read source")
+	}
+	if t.ivacrypt != nil && !isAttrFile(filePath) {
+		if job.srcData, err = t.ivacrypt.decrypt(job.srcData); err != nil {
+			return nil, errors.Wrap(err, "decrypt ivacrypt source")
+		}
+	}
+	if job.opts, err = t.baseOpts.forPath(filePath); err != nil {
+		return nil, err
+	}
+	if !t.encrypt || t.newDadHash == zeroHash || len(job.srcData) == 0 {
+		return job, nil
+	}
+
+	// pull dad file for metadata, follow renames
+	dadLoc := t.newDadHash.String()
+	job.dadPath = filePath
+	job.dadData, err = t.a.readGitFile(filePath, dadLoc)
+	if errors.Cause(err) == errNotFound {
+		job.dadPath, err = t.findRenameSource(filePath, job.srcData)
+		if err == nil && job.dadPath != "" {
+			job.dadData, err = t.a.readGitFile(job.dadPath, dadLoc)
+		}
 	}
 	if err != nil {
-		return errors.Wrap(err, "read source")
+		log.Debugf("%s:%s no dad file: %v", t.shortHash, filePath, err)
+		job.dadData = nil
 	}
-	srcData := []byte(srcText)
+	return job, nil
+}
 
-	// convert the data
-	var dstData []byte
+// runJobs converts prepared files in the pool of workers
+func (t *transformer) runJobs(jobs []*fileJob) {
+	queue := make(chan *fileJob)
+	var wg sync.WaitGroup
+	for i := 0; i < t.jobs && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				t.convertFile(job)
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// convertFile runs in a worker, it must not touch git storage
+func (t *transformer) convertFile(job *fileJob) {
 	switch {
-	case len(srcData) == 0:
-		dstData = srcData
+	case len(job.srcData) == 0:
+		job.dstData = job.srcData
+	case t.revoke != "":
+		job.dstData, job.err = t.revokeFile(job)
+	case t.ivacrypt != nil && isAttrFile(job.path):
+		job.dstData = rewriteAttrs(job.srcData)
 	case t.encrypt:
-		dstData, err = t.encryptFile(filePath, srcData)
+		job.dstData, job.err = t.encryptFile(job)
 	default:
-		dstData, err = t.decryptFile(filePath, srcData)
+		job.dstData, job.err = t.decryptFile(job)
+	}
+}
+
+// storeFile puts conversion result in storage, caches and journals its hash
+func (t *transformer) storeFile(job *fileJob) error {
+	wrap := func(err error, what string) error {
+		return errors.Wrapf(errors.Wrap(err, what), "transform file %s in %s", job.path, job.commit)
+	}
+	if job.err != nil {
+		return wrap(job.err, "transform contents")
 	}
+	dstHash, err := t.a.writeGitBlob(job.dstData)
 	if err != nil {
-		return errors.Wrap(err, "transform contents")
+		return wrap(err, "write result")
 	}
-
-	// put result in storage, return its hash and cache it up
-	if dstHash, err = t.a.writeGitBlob(dstData); err != nil {
-		return errors.Wrapf(err, "write result")
+	t.transCache[job.key] = dstHash
+	t.journal.addBlob(job.key, dstHash)
+	if t.revoke != "" && dstHash != job.key.hash {
+		t.revoked[job.path]++
+	}
+	if job.entry != nil {
+		job.entry.Hash = dstHash
+		// job.entry.Mode &^= 007 // safety chmod "o-rwx" (dangerous)
 	}
-	t.transCache[srcHash] = dstHash
-	entry.Hash = dstHash
-	// entry.Mode &^= 007 // safety chmod "o-rwx" (dangerous)
-
 	log.Debugf("%s:%s transformed %s -> %s",
-		t.shortHash, filePath, shortHash(srcHash), shortHash(dstHash))
-	log.Debugf("file2 tree %q [%s]", parentPath, traceTree(fileTree))
+		job.commit, job.path, shortHash(job.key.hash), shortHash(dstHash))
+	return nil
+}
+
+// prefetchBlobs decrypts distinct secret blobs of all pending commits
+// in batches, so that conversions of many commits run concurrently
+func (t *transformer) prefetchBlobs() error {
+	var batch []*fileJob
+	flush := func() error {
+		t.runJobs(batch)
+		for _, job := range batch {
+			if err := t.storeFile(job); err != nil {
+				return err
+			}
+		}
+		batch = nil
+		return t.journal.flush()
+	}
+	queued := map[transKey]bool{}
+	for _, hash := range t.hashLog {
+		if _, ok := t.knownCommit(hash); ok {
+			continue
+		}
+		t.curHash = hash
+		t.shortHash = shortHash(hash)
+		var tree *object.Tree
+		commit, err := t.a.r.CommitObject(hash)
+		if err == nil {
+			tree, err = commit.Tree()
+		}
+		if err != nil {
+			return errors.Wrapf(err, "get source tree for %s", t.shortHash)
+		}
+		files, err := t.matchFiles(hash)
+		if err != nil {
+			return err
+		}
+		for _, filePath := range files {
+			entry, err := tree.FindEntry(filePath)
+			if err != nil || !entry.Mode.IsFile() || entry.Mode == filemode.Symlink {
+				continue // will fail later in order
+			}
+			key := transKey{path: filePath, hash: entry.Hash}
+			if queued[key] || t.transCache[key] != zeroHash {
+				continue
+			}
+			queued[key] = true
+			job, err := t.prepareFile(filePath, entry.Hash)
+			if err != nil {
+				return errors.Wrapf(err, "transform file %s in %s", filePath, t.shortHash)
+			}
+			batch = append(batch, job)
+			if len(batch) >= prefetchBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Debugf("prefetched %d file(s)", len(queued))
 	return nil
 }
 
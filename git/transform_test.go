@@ -0,0 +1,108 @@
+package git
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"gopkg.in/urfave/cli.v1"
+)
+
+// testAction opens a new repository configured with a generated
+// age identity, run with -race to catch workers sharing state
+func testAction(t *testing.T) (*action, func()) {
+	dir, err := ioutil.TempDir("", "git-sops-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { _ = os.RemoveAll(dir) }
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "keys.txt")
+	if err := ioutil.WriteFile(keyFile, []byte(identity.String()+"\n"), permSecret); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	oldKeyFile, hadKeyFile := os.LookupEnv("SOPS_AGE_KEY_FILE")
+	_ = os.Setenv("SOPS_AGE_KEY_FILE", keyFile)
+	restore := func() {
+		if hadKeyFile {
+			_ = os.Setenv("SOPS_AGE_KEY_FILE", oldKeyFile)
+		} else {
+			_ = os.Unsetenv("SOPS_AGE_KEY_FILE")
+		}
+		cleanup()
+	}
+
+	r, err := git.PlainInit(filepath.Join(dir, "repo"), false)
+	if err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Bool("enable-local-keyservice", true, "")
+	a := &action{c: cli.NewContext(cli.NewApp(), flags, nil), r: r}
+	a.s = r.Storer.(*filesystem.Storage)
+	if a.w, err = r.Worktree(); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	a.d = a.w.Filesystem.Root()
+	if err := a.setString(optAge, identity.Recipient().String()); err != nil {
+		restore()
+		t.Fatal(err)
+	}
+	return a, restore
+}
+
+func TestRunJobsParallel(t *testing.T) {
+	a, cleanup := testAction(t)
+	defer cleanup()
+	baseOpts, err := a.getOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &transformer{a: a, encrypt: true, jobs: 4, baseOpts: baseOpts}
+
+	var jobs []*fileJob
+	for i := 0; i < 16; i++ {
+		path := fmt.Sprintf("secret%d.yaml", i)
+		opts, err := baseOpts.forPath(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte(fmt.Sprintf("key: value%d\n", i))
+		jobs = append(jobs, &fileJob{path: path, opts: opts, srcData: data})
+	}
+	tr.runJobs(jobs)
+
+	// fresh action, so that data keys are not taken from the cache
+	b := &action{c: a.c, r: a.r, s: a.s, w: a.w, d: a.d}
+	for _, job := range jobs {
+		if job.err != nil {
+			t.Errorf("%s: %v", job.path, job.err)
+			continue
+		}
+		opts, err := baseOpts.forPath(job.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.a = b
+		opts.inputData = job.dstData
+		plain, err := b.sopsDecrypt(opts)
+		if err != nil {
+			t.Errorf("%s: %v", job.path, err)
+		} else if string(plain) != string(job.srcData) {
+			t.Errorf("%s: expected %q, got %q", job.path, job.srcData, plain)
+		}
+	}
+}
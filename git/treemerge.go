@@ -0,0 +1,207 @@
+package git
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/stores/dotenv"
+	"go.mozilla.org/sops/v3/stores/json"
+	"go.mozilla.org/sops/v3/stores/yaml"
+
+	"github.com/pkg/errors"
+)
+
+// merge sides, in the order of merge-file arguments
+const (
+	mergeCurrent = iota
+	mergeAncestor
+	mergeOther
+	mergeSides
+)
+
+var errNoTreeMerge = errors.New("tree merge is not possible")
+
+// absent stands for a key missing on some side of the merge
+type absent struct{}
+
+// treeMerger merges three trees per key path, taking unresolved
+// values from the given side and recording their key paths
+type treeMerger struct {
+	side      int
+	conflicts []string
+}
+
+// canTreeMerge tells whether the store keeps a key-value tree.
+// Binary and ini files are left for line-based merge.
+func canTreeMerge(store sops.Store) bool {
+	switch store.(type) {
+	case *yaml.Store, *json.Store, *dotenv.Store:
+		return true
+	}
+	return false
+}
+
+// treeMerge merges plain texts of the sides per key path. Order and
+// comments follow the current side. If some keys conflict, the texts
+// of every side are returned with non-conflicting changes applied,
+// so that merge-file puts markers around conflicting keys only.
+func (a *action) treeMerge(opts *options, texts [mergeSides][]byte) ([mergeSides][]byte, []string, error) {
+	var results [mergeSides][]byte
+	if !canTreeMerge(opts.inputStore) {
+		return results, nil, errNoTreeMerge
+	}
+	var trees [mergeSides]sops.TreeBranches
+	for side, text := range texts {
+		if len(text) == 0 && side == mergeAncestor {
+			trees[side] = sops.TreeBranches{sops.TreeBranch{}}
+			continue
+		}
+		if len(text) == 0 {
+			return results, nil, errNoTreeMerge
+		}
+		text = opts.mangling.Mangle(text, opts.inputPath, false)
+		branches, err := opts.inputStore.LoadPlainFile(text)
+		if err != nil {
+			return results, nil, errors.Wrap(errNoTreeMerge, err.Error())
+		}
+		trees[side] = branches
+	}
+
+	var conflicts []string
+	for side := range results {
+		m := &treeMerger{side: side}
+		merged, err := m.mergeTrees(trees[mergeAncestor], trees[mergeCurrent], trees[mergeOther])
+		if err != nil {
+			return results, nil, err
+		}
+		output, err := opts.outputStore.EmitPlainFile(merged)
+		if err != nil {
+			return results, nil, err
+		}
+		results[side] = opts.mangling.Demangle(output, opts.inputPath, false)
+		conflicts = m.conflicts
+	}
+	return results, conflicts, nil
+}
+
+// mergeTrees merges documents of multi-document files one by one
+func (m *treeMerger) mergeTrees(base, cur, oth sops.TreeBranches) (sops.TreeBranches, error) {
+	if len(cur) != len(oth) {
+		return nil, errors.Wrap(errNoTreeMerge, "number of documents differs")
+	}
+	merged := make(sops.TreeBranches, len(cur))
+	for i := range cur {
+		var baseBranch sops.TreeBranch
+		if i < len(base) {
+			baseBranch = base[i]
+		}
+		path := ""
+		if len(cur) > 1 {
+			path = fmt.Sprintf("[%d]", i)
+		}
+		merged[i] = m.mergeBranches(path, baseBranch, cur[i], oth[i])
+	}
+	return merged, nil
+}
+
+// mergeValues resolves one key path, descending into maps changed on both sides
+func (m *treeMerger) mergeValues(path string, base, cur, oth interface{}) interface{} {
+	switch {
+	case reflect.DeepEqual(cur, oth):
+		return cur
+	case reflect.DeepEqual(base, cur):
+		return oth
+	case reflect.DeepEqual(base, oth):
+		return cur
+	}
+	curBranch, curOK := cur.(sops.TreeBranch)
+	othBranch, othOK := oth.(sops.TreeBranch)
+	if curOK && othOK {
+		baseBranch, _ := base.(sops.TreeBranch)
+		return m.mergeBranches(path, baseBranch, curBranch, othBranch)
+	}
+	m.conflicts = append(m.conflicts, path)
+	switch m.side {
+	case mergeAncestor:
+		return base
+	case mergeOther:
+		return oth
+	}
+	return cur
+}
+
+// branchItem is a key with comments preceding it
+type branchItem struct {
+	comments []sops.TreeItem
+	item     sops.TreeItem
+}
+
+// splitBranch groups comments with the next key, trailing comments go last
+func splitBranch(branch sops.TreeBranch) (items []branchItem, index map[interface{}]int, trailer []sops.TreeItem) {
+	index = map[interface{}]int{}
+	for _, item := range branch {
+		if _, ok := item.Key.(sops.Comment); ok {
+			trailer = append(trailer, item)
+			continue
+		}
+		index[item.Key] = len(items)
+		items = append(items, branchItem{comments: trailer, item: item})
+		trailer = nil
+	}
+	return
+}
+
+// mergeBranches merges maps. Keys of the current side keep their order,
+// keys added by the other side are placed before their next neighbour.
+func (m *treeMerger) mergeBranches(path string, base, cur, oth sops.TreeBranch) sops.TreeBranch {
+	baseItems, baseIndex, _ := splitBranch(base)
+	curItems, curIndex, curTrailer := splitBranch(cur)
+	othItems, othIndex, _ := splitBranch(oth)
+
+	// keys only known to the other side, grouped by the next common key
+	var added []branchItem
+	addedBefore := map[interface{}][]branchItem{}
+	for _, it := range othItems {
+		if _, ok := curIndex[it.item.Key]; ok {
+			addedBefore[it.item.Key] = added
+			added = nil
+			continue
+		}
+		added = append(added, it)
+	}
+
+	value := func(items []branchItem, index map[interface{}]int, key interface{}) interface{} {
+		if i, ok := index[key]; ok {
+			return items[i].item.Value
+		}
+		return absent{}
+	}
+	result := sops.TreeBranch{}
+	emit := func(it branchItem) {
+		key := it.item.Key
+		keyPath := fmt.Sprint(key)
+		if path != "" {
+			keyPath = path + "." + keyPath
+		}
+		merged := m.mergeValues(keyPath,
+			value(baseItems, baseIndex, key),
+			value(curItems, curIndex, key),
+			value(othItems, othIndex, key))
+		if _, ok := merged.(absent); ok {
+			return
+		}
+		result = append(result, it.comments...)
+		result = append(result, sops.TreeItem{Key: key, Value: merged})
+	}
+	for _, it := range curItems {
+		for _, ot := range addedBefore[it.item.Key] {
+			emit(ot)
+		}
+		emit(it)
+	}
+	for _, ot := range added {
+		emit(ot)
+	}
+	return append(result, curTrailer...)
+}
@@ -0,0 +1,103 @@
+package git
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mozilla.org/sops/v3/stores/yaml"
+)
+
+func TestTreeMerge(t *testing.T) {
+	tests := []struct {
+		name                     string
+		ancestor, current, other string
+		merged                   string
+		conflicts                []string
+	}{
+		{
+			name:     "neighbour keys added",
+			ancestor: "a: 1\nb: 2\n",
+			current:  "a: 1\nx: 3\nb: 2\n",
+			other:    "a: 1\nz: 4\nb: 2\n",
+			merged:   "a: 1\nx: 3\nz: 4\nb: 2\n",
+		},
+		{
+			name:     "order and comments of current",
+			ancestor: "a: 1\nb: 2\n",
+			current:  "# about b\nb: 2\na: 1\n",
+			other:    "a: 1\nb: 5\n",
+			merged:   "# about b\nb: 5\na: 1\n",
+		},
+		{
+			name:     "nested changes",
+			ancestor: "db:\n    user: u\n    pass: p\n",
+			current:  "db:\n    user: admin\n    pass: p\n",
+			other:    "db:\n    user: u\n    pass: secret\n    port: 5432\n",
+			merged:   "db:\n    user: admin\n    pass: secret\n    port: 5432\n",
+		},
+		{
+			name:     "deleted keys",
+			ancestor: "a: 1\nb: 2\nc: 3\n",
+			current:  "a: 1\nc: 3\n",
+			other:    "a: 1\nb: 2\nc: 4\n",
+			merged:   "a: 1\nc: 4\n",
+		},
+		{
+			name:      "conflicting keys",
+			ancestor:  "a: 1\nb:\n    c: 2\n    d: 3\n",
+			current:   "a: 5\nb:\n    c: 6\n    d: 3\n",
+			other:     "a: 1\nb:\n    c: 7\n",
+			merged:    "a: 5\nb:\n    c: 6\n",
+			conflicts: []string{"b.c"},
+		},
+		{
+			name:      "modified and deleted",
+			ancestor:  "a: 1\nb: 2\n",
+			current:   "a: 1\n",
+			other:     "a: 1\nb: 3\n",
+			merged:    "a: 1\n",
+			conflicts: []string{"b"},
+		},
+		{
+			name:      "added on both sides",
+			ancestor:  "",
+			current:   "a: 1\nb: 2\n",
+			other:     "a: 1\nb: 3\n",
+			merged:    "a: 1\nb: 2\n",
+			conflicts: []string{"b"},
+		},
+	}
+
+	store := &yaml.Store{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, err := store.LoadPlainFile([]byte(tt.ancestor))
+			if err != nil || len(base) == 0 {
+				base = nil
+			}
+			cur, err := store.LoadPlainFile([]byte(tt.current))
+			if err != nil {
+				t.Fatal(err)
+			}
+			oth, err := store.LoadPlainFile([]byte(tt.other))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &treeMerger{side: mergeCurrent}
+			merged, err := m.mergeTrees(base, cur, oth)
+			if err != nil {
+				t.Fatal(err)
+			}
+			output, err := store.EmitPlainFile(merged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(output) != tt.merged {
+				t.Errorf("merged:\n%s\nwant:\n%s", output, tt.merged)
+			}
+			if !reflect.DeepEqual(m.conflicts, tt.conflicts) {
+				t.Errorf("conflicts %v, want %v", m.conflicts, tt.conflicts)
+			}
+		})
+	}
+}
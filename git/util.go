@@ -17,9 +17,15 @@ import (
 	"go.mozilla.org/sops/v3/cmd/sops/common"
 )
 
-const permSecret = 0600
+const (
+	permSecret    = 0600
+	permSecretDir = 0700
+)
 
-var errInvalidAgeRecs = errors.New("invalid or absent encryption password")
+var (
+	errInvalidAgeRecs = errors.New("invalid or absent encryption password")
+	errNoMasterKeys   = errors.New("no master keys configured")
+)
 
 func getInput(path string, stdin bool) (data []byte, err error) {
 	if stdin {
@@ -30,7 +36,8 @@ func getInput(path string, stdin bool) (data []byte, err error) {
 	return
 }
 
-// age recipients must be present as a comment in the age key file
+// at least one of age recipients must be present as a comment in
+// the age key file, team members hold their own identities only
 func validateAgeRecipients(ageRecipients string) error {
 	if ageRecipients == "" {
 		return errInvalidAgeRecs
@@ -46,13 +53,27 @@ func validateAgeRecipients(ageRecipients string) error {
 	}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return errors.Wrapf(err, "failed to open file %s")
+		return errors.Wrapf(err, "failed to open file %s", path)
 	}
 
-	if !bytes.Contains(data, []byte(ageRecipients)) {
-		return errInvalidAgeRecs
+	split := func(r rune) bool { return r == ',' || r == '|' }
+	for _, recipient := range strings.FieldsFunc(ageRecipients, split) {
+		recipient = strings.TrimSpace(recipient)
+		if recipient != "" && bytes.Contains(data, []byte(recipient)) {
+			return nil
+		}
 	}
-	return nil
+	return errInvalidAgeRecs
+}
+
+// at least one master key must be configured
+func validateKeyGroups(groups []sops.KeyGroup) error {
+	for _, group := range groups {
+		if len(group) > 0 {
+			return nil
+		}
+	}
+	return errNoMasterKeys
 }
 
 func extractMetadata(path string, data []byte, opts *options) (*sops.Metadata, error) {
@@ -68,9 +89,9 @@ func extractMetadata(path string, data []byte, opts *options) (*sops.Metadata, e
 		return nil, err
 	}
 	meta := &tree.Metadata
-	dataKey, err := meta.GetDataKeyWithKeyServices(opts.keyServices)
+	dataKey, err := opts.a.getDataKey(meta, opts.keyServices)
 	if err != nil {
-		return nil, err
+		return nil, dataKeyExitError(err)
 	}
 	meta.DataKey = dataKey
 	return meta, nil
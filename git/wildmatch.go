@@ -0,0 +1,292 @@
+package git
+
+import (
+	"bytes"
+)
+
+// wildmatch flags
+const (
+	wmCaseFold = 1 << iota // case insensitive match
+	wmPathname             // wildcards do not match slash, "**" can
+)
+
+// wildmatch results
+const (
+	wmMatch = iota
+	wmNoMatch
+	wmAbortAll
+	wmAbortToStarStar
+)
+
+// wildmatch matches text against a shell glob pattern following the rules
+// of git's wildmatch.c: "?", "*", "**", character classes with ranges,
+// negation by "!" or "^", POSIX "[:class:]" names and backslash escapes.
+func wildmatch(pattern, text string, flags int) bool {
+	return doWild([]byte(pattern), []byte(text), flags) == wmMatch
+}
+
+// at returns byte at index or zero past the end, like a C string
+func at(s []byte, i int) byte {
+	if i < len(s) {
+		return s[i]
+	}
+	return 0
+}
+
+func isGlobSpecial(c byte) bool {
+	return c == '*' || c == '?' || c == '[' || c == '\\'
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func toUpper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
+
+func doWild(pat, text []byte, flags int) int {
+	p, t := 0, 0
+	for ; at(pat, p) != 0; p, t = p+1, t+1 {
+		pCh := at(pat, p)
+		tCh := at(text, t)
+		if tCh == 0 && pCh != '*' {
+			return wmAbortAll
+		}
+		if flags&wmCaseFold != 0 {
+			tCh = toLower(tCh)
+			pCh = toLower(pCh)
+		}
+		switch pCh {
+		case '\\':
+			// literal match with the following character
+			p++
+			pCh = at(pat, p)
+			if tCh != pCh {
+				return wmNoMatch
+			}
+		default:
+			if tCh != pCh {
+				return wmNoMatch
+			}
+		case '?':
+			// match anything but slash
+			if flags&wmPathname != 0 && tCh == '/' {
+				return wmNoMatch
+			}
+		case '*':
+			var matchSlash bool
+			p++
+			if at(pat, p) == '*' {
+				prevP := p - 2
+				for p++; at(pat, p) == '*'; p++ {
+				}
+				if flags&wmPathname == 0 {
+					// without wmPathname "**" is the same as "*"
+					matchSlash = true
+				} else if (prevP < 0 || pat[prevP] == '/') &&
+					(at(pat, p) == 0 || at(pat, p) == '/' ||
+						(at(pat, p) == '\\' && at(pat, p+1) == '/')) {
+					// assuming we already match "foo/" and are at "**/",
+					// try to match nothing and go ahead with the rest,
+					// so that "foo/**/bar" matches both "foo/bar" and "foo/a/bar"
+					if at(pat, p) == '/' && doWild(pat[p+1:], text[t:], flags) == wmMatch {
+						return wmMatch
+					}
+					matchSlash = true
+				} else {
+					matchSlash = false // wmPathname is set
+				}
+			} else {
+				// without wmPathname "*" is the same as "**"
+				matchSlash = flags&wmPathname == 0
+			}
+			if at(pat, p) == 0 {
+				// trailing "**" matches everything,
+				// trailing "*" matches only if there are no more slashes
+				if !matchSlash && bytes.IndexByte(text[t:], '/') != -1 {
+					return wmNoMatch
+				}
+				return wmMatch
+			} else if !matchSlash && at(pat, p) == '/' {
+				// single asterisk followed by slash matches the next directory
+				slash := bytes.IndexByte(text[t:], '/')
+				if slash == -1 {
+					return wmNoMatch
+				}
+				t += slash
+				// the slash is consumed by the loop
+				continue
+			}
+			for {
+				if tCh == 0 {
+					break
+				}
+				// advance faster when asterisk is followed by a literal,
+				// do not look past slash unless it can belong to asterisk
+				if !isGlobSpecial(at(pat, p)) {
+					pCh = at(pat, p)
+					if flags&wmCaseFold != 0 {
+						pCh = toLower(pCh)
+					}
+					for {
+						tCh = at(text, t)
+						if tCh == 0 || (!matchSlash && tCh == '/') {
+							break
+						}
+						if flags&wmCaseFold != 0 {
+							tCh = toLower(tCh)
+						}
+						if tCh == pCh {
+							break
+						}
+						t++
+					}
+					if tCh != pCh {
+						return wmNoMatch
+					}
+				}
+				if matched := doWild(pat[p:], text[t:], flags); matched != wmNoMatch {
+					if !matchSlash || matched != wmAbortToStarStar {
+						return matched
+					}
+				} else if !matchSlash && tCh == '/' {
+					return wmAbortToStarStar
+				}
+				t++
+				tCh = at(text, t)
+			}
+			return wmAbortAll
+		case '[':
+			p++
+			pCh = at(pat, p)
+			negated := pCh == '!' || pCh == '^'
+			if negated {
+				p++
+				pCh = at(pat, p)
+			}
+			var prevCh byte
+			matched := false
+			for {
+				if pCh == 0 {
+					return wmAbortAll
+				}
+				switch {
+				case pCh == '\\':
+					p++
+					pCh = at(pat, p)
+					if pCh == 0 {
+						return wmAbortAll
+					}
+					if tCh == pCh {
+						matched = true
+					}
+				case pCh == '-' && prevCh != 0 && at(pat, p+1) != 0 && at(pat, p+1) != ']':
+					p++
+					pCh = at(pat, p)
+					if pCh == '\\' {
+						p++
+						pCh = at(pat, p)
+						if pCh == 0 {
+							return wmAbortAll
+						}
+					}
+					if tCh <= pCh && tCh >= prevCh {
+						matched = true
+					} else if flags&wmCaseFold != 0 && tCh >= 'a' && tCh <= 'z' {
+						if up := toUpper(tCh); up <= pCh && up >= prevCh {
+							matched = true
+						}
+					}
+					pCh = 0 // makes prevCh zero
+				case pCh == '[' && at(pat, p+1) == ':':
+					p += 2
+					start := p
+					for pCh = at(pat, p); pCh != 0 && pCh != ']'; pCh = at(pat, p) {
+						p++
+					}
+					if pCh == 0 {
+						return wmAbortAll
+					}
+					if p-start-1 < 0 || pat[p-1] != ':' {
+						// did not find ":]", treat like a normal set
+						p = start - 2
+						pCh = '['
+						if tCh == pCh {
+							matched = true
+						}
+						break
+					}
+					class := string(pat[start : p-1])
+					ok, valid := matchCharClass(class, tCh, flags)
+					if !valid {
+						return wmAbortAll // malformed class name
+					}
+					if ok {
+						matched = true
+					}
+					pCh = 0 // makes prevCh zero
+				default:
+					if tCh == pCh {
+						matched = true
+					}
+				}
+				prevCh = pCh
+				p++
+				if pCh = at(pat, p); pCh == ']' {
+					break
+				}
+			}
+			if matched == negated || (flags&wmPathname != 0 && tCh == '/') {
+				return wmNoMatch
+			}
+		}
+	}
+	if t < len(text) {
+		return wmNoMatch
+	}
+	return wmMatch
+}
+
+// matchCharClass tests character against a POSIX class like "alpha"
+func matchCharClass(class string, c byte, flags int) (ok, valid bool) {
+	isUpper := c >= 'A' && c <= 'Z'
+	isLower := c >= 'a' && c <= 'z'
+	isDigit := c >= '0' && c <= '9'
+	isAlpha := isUpper || isLower
+	isSpace := c == ' ' || (c >= '\t' && c <= '\r')
+	isPrint := c >= 0x20 && c < 0x7f
+	switch class {
+	case "alnum":
+		return isAlpha || isDigit, true
+	case "alpha":
+		return isAlpha, true
+	case "blank":
+		return c == ' ' || c == '\t', true
+	case "cntrl":
+		return c < 0x20 || c == 0x7f, true
+	case "digit":
+		return isDigit, true
+	case "graph":
+		return isPrint && c != ' ', true
+	case "lower":
+		return isLower, true
+	case "print":
+		return isPrint, true
+	case "punct":
+		return isPrint && c != ' ' && !isAlpha && !isDigit, true
+	case "space":
+		return isSpace, true
+	case "upper":
+		return isUpper || (flags&wmCaseFold != 0 && isLower), true
+	case "xdigit":
+		return isDigit || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F'), true
+	}
+	return false, false
+}
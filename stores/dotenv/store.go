@@ -42,6 +42,9 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 		}
 	}
 
+	if len(mdMap) == 0 {
+		return sops.Tree{}, sops.MetadataNotFound
+	}
 	metadata, err := mapToMetadata(mdMap)
 	if err != nil {
 		return sops.Tree{}, err
@@ -65,7 +68,7 @@ func (store *Store) LoadPlainFile(in []byte) (sops.TreeBranches, error) {
 	var branches sops.TreeBranches
 	var branch sops.TreeBranch
 
-	for _, line := range bytes.Split(in, []byte("\n")) {
+	for lineNo, line := range bytes.Split(in, []byte("\n")) {
 		if len(line) == 0 {
 			continue
 		}
@@ -77,7 +80,9 @@ func (store *Store) LoadPlainFile(in []byte) (sops.TreeBranches, error) {
 		} else {
 			pos := bytes.Index(line, []byte("="))
 			if pos == -1 {
-				return nil, fmt.Errorf("invalid dotenv input line: %s", line)
+				err := stores.NewParseError("dotenv", in, fmt.Errorf("invalid line: %s", line))
+				err.Line = lineNo + 1
+				return nil, err
 			}
 			branch = append(branch, sops.TreeItem{
 				Key:   string(line[:pos]),
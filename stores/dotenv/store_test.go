@@ -1,11 +1,13 @@
 package dotenv
 
 import (
+	"errors"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/stores"
 )
 
 var PLAIN = []byte(strings.TrimLeft(`
@@ -53,6 +55,18 @@ func TestEmitPlainFile(t *testing.T) {
 	assert.Equal(t, PLAIN, bytes)
 }
 
+func TestUnmarshalMetadataFromNonSOPSFile(t *testing.T) {
+	_, err := (&Store{}).LoadEncryptedFile(PLAIN)
+	assert.Equal(t, sops.MetadataNotFound, err)
+}
+
+func TestInvalidLine(t *testing.T) {
+	_, err := (&Store{}).LoadPlainFile([]byte("VAR1=val1\noops\n"))
+	var parseErr *stores.ParseError
+	assert.True(t, errors.As(err, &parseErr))
+	assert.Equal(t, 2, parseErr.Line)
+}
+
 func TestEmitValueString(t *testing.T) {
 	bytes, err := (&Store{}).EmitValue("hello")
 	assert.Nil(t, err)
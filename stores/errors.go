@@ -0,0 +1,79 @@
+package stores
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ErrConflict matches parse errors of inputs containing merge conflict markers
+var ErrConflict = errors.New("merge conflict markers found")
+
+// ParseError occurs when the input can't be parsed in the store format
+type ParseError struct {
+	// Format is the store format, e.g. "yaml"
+	Format string
+	// Line and Column of the error position, counted from 1, zero if unknown
+	Line   int
+	Column int
+	// Conflict tells that the input contains merge conflict markers
+	Conflict bool
+	// Err is the underlying parser error
+	Err error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("Error unmarshalling input %s: %s", e.Format, e.Err)
+}
+
+// Unwrap returns the underlying parser error
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrConflict) true for conflicted inputs
+func (e *ParseError) Is(target error) bool {
+	return target == ErrConflict && e.Conflict
+}
+
+var lineRegexp = regexp.MustCompile(`\bline (\d+)\b`)
+
+// NewParseError wraps a parser error of the input, the line is taken
+// from the error message if the parser reports it
+func NewParseError(format string, in []byte, err error) *ParseError {
+	e := &ParseError{
+		Format:   format,
+		Conflict: HasConflictMarkers(in),
+		Err:      err,
+	}
+	if m := lineRegexp.FindStringSubmatch(err.Error()); m != nil {
+		e.Line, _ = strconv.Atoi(m[1])
+	}
+	return e
+}
+
+// NewParseErrorAt wraps a parser error at given byte offset of the input
+func NewParseErrorAt(format string, in []byte, offset int, err error) *ParseError {
+	e := NewParseError(format, in, err)
+	if offset > len(in) {
+		offset = len(in)
+	}
+	if offset >= 0 {
+		head := in[:offset]
+		e.Line = bytes.Count(head, []byte("\n")) + 1
+		e.Column = offset - bytes.LastIndexByte(head, '\n')
+	}
+	return e
+}
+
+// HasConflictMarkers tells whether the input contains both opening
+// and closing merge conflict markers at line starts
+func HasConflictMarkers(in []byte) bool {
+	hasMarker := func(marker string) bool {
+		m := []byte(marker)
+		return bytes.HasPrefix(in, m) || bytes.Contains(in, append([]byte("\n"), m...))
+	}
+	return hasMarker("<<<<<<< ") && hasMarker(">>>>>>> ")
+}
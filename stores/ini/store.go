@@ -91,7 +91,7 @@ func (store Store) iniFromTreeBranches(branches sops.TreeBranches) ([]byte, erro
 func (store Store) treeBranchesFromIni(in []byte) (sops.TreeBranches, error) {
 	iniFile, err := ini.Load(in)
 	if err != nil {
-		return nil, err
+		return nil, stores.NewParseError("ini", in, err)
 	}
 	var branch sops.TreeBranch
 	for _, section := range iniFile.Sections() {
@@ -139,7 +139,7 @@ func (store Store) treeItemFromSection(section *ini.Section) (sops.TreeItem, err
 func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 	iniFileOuter, err := ini.Load(in)
 	if err != nil {
-		return sops.Tree{}, err
+		return sops.Tree{}, stores.NewParseError("ini", in, err)
 	}
 
 	sopsSection, err := iniFileOuter.GetSection("sops")
@@ -159,7 +159,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 	// After that, we load the whole file into a map.
 	branches, err := store.treeBranchesFromIni(in)
 	if err != nil {
-		return sops.Tree{}, fmt.Errorf("Could not unmarshal input data: %s", err)
+		return sops.Tree{}, fmt.Errorf("Could not unmarshal input data: %w", err)
 	}
 	// Discard metadata, as we already loaded it.
 	for bi, branch := range branches {
@@ -196,7 +196,7 @@ func (store *Store) iniSectionToMetadata(sopsSection *ini.Section) (stores.Metad
 func (store *Store) LoadPlainFile(in []byte) (sops.TreeBranches, error) {
 	branches, err := store.treeBranchesFromIni(in)
 	if err != nil {
-		return branches, fmt.Errorf("Could not unmarshal input data: %s", err)
+		return branches, fmt.Errorf("Could not unmarshal input data: %w", err)
 	}
 	return branches, nil
 }
@@ -3,6 +3,7 @@ package json //import "go.mozilla.org/sops/v3/stores/json"
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 
@@ -21,7 +22,13 @@ type BinaryStore struct {
 
 // LoadEncryptedFile loads an encrypted json file onto a sops.Tree object
 func (store BinaryStore) LoadEncryptedFile(in []byte) (sops.Tree, error) {
-	return store.store.LoadEncryptedFile(in)
+	tree, err := store.store.LoadEncryptedFile(in)
+	var parseErr *stores.ParseError
+	if errors.As(err, &parseErr) {
+		// encrypted binary data is always wrapped in JSON
+		return sops.Tree{}, sops.MetadataNotFound
+	}
+	return tree, err
 }
 
 // LoadPlainFile loads a plaintext json file onto a sops.Tree encapsulated
@@ -215,6 +222,14 @@ func (store Store) treeBranchFromJSON(in []byte) (sops.TreeBranch, error) {
 	return store.treeBranchFromJSONDecoder(dec)
 }
 
+// parseError wraps JSON decoder error, syntax errors provide position
+func parseError(in []byte, err error) error {
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		return stores.NewParseErrorAt("json", in, int(syntaxErr.Offset), err)
+	}
+	return stores.NewParseError("json", in, err)
+}
+
 func (store Store) reindentJSON(in []byte) ([]byte, error) {
 	var out bytes.Buffer
 	err := json.Indent(&out, in, "", "\t")
@@ -239,7 +254,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 						"using `sops -r your_file.json`")
 			}
 		}
-		return sops.Tree{}, fmt.Errorf("Error unmarshalling input json: %s", err)
+		return sops.Tree{}, parseError(in, err)
 	}
 	if metadataHolder.Metadata == nil {
 		return sops.Tree{}, sops.MetadataNotFound
@@ -251,7 +266,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 	// After that, we load the whole file into a map.
 	branch, err := store.treeBranchFromJSON(in)
 	if err != nil {
-		return sops.Tree{}, fmt.Errorf("Could not unmarshal input data: %s", err)
+		return sops.Tree{}, parseError(in, err)
 	}
 	// Discard metadata, as we already loaded it.
 	for i, item := range branch {
@@ -271,7 +286,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 func (store *Store) LoadPlainFile(in []byte) (sops.TreeBranches, error) {
 	branch, err := store.treeBranchFromJSON(in)
 	if err != nil {
-		return nil, fmt.Errorf("Could not unmarshal input data: %s", err)
+		return nil, parseError(in, err)
 	}
 	return sops.TreeBranches{
 		branch,
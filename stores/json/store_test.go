@@ -1,10 +1,12 @@
 package json
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/stores"
 )
 
 func TestDecodeJSON(t *testing.T) {
@@ -310,6 +312,20 @@ func TestUnmarshalMetadataFromNonSOPSFile(t *testing.T) {
 	assert.Equal(t, sops.MetadataNotFound, err)
 }
 
+func TestParseErrorPosition(t *testing.T) {
+	data := []byte("{\n  \"hello\": 2,\n  oops\n}")
+	_, err := (&Store{}).LoadPlainFile(data)
+	var parseErr *stores.ParseError
+	assert.True(t, errors.As(err, &parseErr))
+	assert.Equal(t, 3, parseErr.Line)
+	assert.False(t, errors.Is(err, stores.ErrConflict))
+}
+
+func TestLoadNonJSONBinaryFile(t *testing.T) {
+	_, err := BinaryStore{}.LoadEncryptedFile([]byte("plain text"))
+	assert.Equal(t, sops.MetadataNotFound, err)
+}
+
 func TestLoadJSONFormattedBinaryFile(t *testing.T) {
 	// This is JSON data, but we want SOPS to interpret it as binary,
 	// e.g. because the --input-type binary flag was provided.
@@ -249,7 +249,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 	metadataHolder := stores.SopsFile{}
 	err := yaml.Unmarshal(in, &metadataHolder)
 	if err != nil {
-		return sops.Tree{}, fmt.Errorf("Error unmarshalling input yaml: %s", err)
+		return sops.Tree{}, stores.NewParseError("yaml", in, err)
 	}
 	if metadataHolder.Metadata == nil {
 		return sops.Tree{}, sops.MetadataNotFound
@@ -260,7 +260,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 	}
 	var data yaml.Node
 	if err := yaml.Unmarshal(in, &data); err != nil {
-		return sops.Tree{}, fmt.Errorf("Error unmarshaling input YAML: %s", err)
+		return sops.Tree{}, stores.NewParseError("yaml", in, err)
 	}
 	var branches sops.TreeBranches
 	d := yaml.NewDecoder(bytes.NewReader(in))
@@ -271,7 +271,7 @@ func (store *Store) LoadEncryptedFile(in []byte) (sops.Tree, error) {
 			break
 		}
 		if err != nil {
-			return sops.Tree{}, fmt.Errorf("Error unmarshaling input YAML: %s", err)
+			return sops.Tree{}, stores.NewParseError("yaml", in, err)
 		}
 
 		branch, err := store.yamlDocumentNodeToTreeBranch(data)
@@ -304,7 +304,7 @@ func (store *Store) LoadPlainFile(in []byte) (sops.TreeBranches, error) {
 			break
 		}
 		if err != nil {
-			return nil, fmt.Errorf("Error unmarshaling input YAML: %s", err)
+			return nil, stores.NewParseError("yaml", in, err)
 		}
 
 		branch, err := store.yamlDocumentNodeToTreeBranch(data)
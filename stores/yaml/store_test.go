@@ -1,10 +1,12 @@
 package yaml
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"go.mozilla.org/sops/v3"
+	"go.mozilla.org/sops/v3/stores"
 )
 
 var PLAIN = []byte(`---
@@ -117,6 +119,16 @@ func TestUnmarshalMetadataFromNonSOPSFile(t *testing.T) {
 	assert.Equal(t, sops.MetadataNotFound, err)
 }
 
+func TestLoadConflictedFile(t *testing.T) {
+	data := []byte("key1: value\n<<<<<<< CURRENT\nkey2: a\n=======\nkey2: b\n>>>>>>> OTHER\n")
+	_, err := (&Store{}).LoadEncryptedFile(data)
+	assert.True(t, errors.Is(err, stores.ErrConflict))
+	var parseErr *stores.ParseError
+	assert.True(t, errors.As(err, &parseErr))
+	assert.Equal(t, "yaml", parseErr.Format)
+	assert.NotZero(t, parseErr.Line)
+}
+
 func TestLoadPlainFile(t *testing.T) {
 	branches, err := (&Store{}).LoadPlainFile(PLAIN)
 	assert.Nil(t, err)
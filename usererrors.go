@@ -1,6 +1,7 @@
 package sops
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
@@ -8,6 +9,8 @@ import (
 	"github.com/fatih/color"
 	"github.com/goware/prefixer"
 	wordwrap "github.com/mitchellh/go-wordwrap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // UserError is a well-formatted error for the purpose of being displayed to
@@ -20,6 +23,10 @@ type UserError interface {
 var statusSuccess = color.New(color.FgGreen).Sprint("SUCCESS")
 var statusFailed = color.New(color.FgRed).Sprint("FAILED")
 
+// ErrKeyServiceUnavailable matches errors getting the data key when some
+// key service could not be reached, so that the keys may be there
+var ErrKeyServiceUnavailable = errors.New("key service unavailable")
+
 type getDataKeyError struct {
 	RequiredSuccessfulKeyGroups int
 	GroupResults                []error
@@ -41,6 +48,17 @@ func (err *getDataKeyError) Error() string {
 		err.successfulKeyGroups())
 }
 
+// Is makes errors.Is(err, ErrKeyServiceUnavailable) true if a key service
+// of some group could not be reached
+func (err *getDataKeyError) Is(target error) bool {
+	for _, r := range err.GroupResults {
+		if r != nil && errors.Is(r, target) {
+			return true
+		}
+	}
+	return false
+}
+
 func (err *getDataKeyError) UserError() string {
 	var groupErrs []string
 	for i, res := range err.GroupResults {
@@ -107,6 +125,15 @@ func (e decryptKeyErrors) Error() string {
 	return fmt.Sprintf("error decrypting key: %s", []error(e))
 }
 
+func (e decryptKeyErrors) Is(target error) bool {
+	for _, err := range []error(e) {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 func (e decryptKeyErrors) UserError() string {
 	var errStrs []string
 	for _, err := range []error(e) {
@@ -133,6 +160,19 @@ func (e *decryptKeyError) isSuccessful() bool {
 	return false
 }
 
+func (e *decryptKeyError) Is(target error) bool {
+	if target != ErrKeyServiceUnavailable {
+		return false
+	}
+	for _, err := range e.errs {
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			return true
+		}
+	}
+	return false
+}
+
 func (e *decryptKeyError) Error() string {
 	return fmt.Sprintf("error decrypting key %s: %s", e.keyName, e.errs)
 }